@@ -6,10 +6,36 @@
 package trie
 
 import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"math/rand"
+	"slices"
 	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
+	"unsafe"
 )
 
+// node's children stay a map even on dense nodes: a sorted slice with
+// binary search only matched map lookups up to a few hundred children
+// and fell behind beyond that, as BenchmarkFindDenseNode showed.
+//
+// parent is the one field a write may change on a node it did not
+// create, so the reads that take no lock under WithLockFreeReads must
+// never follow it; see Trie.own.
 type node[T any] struct {
 	val       rune
 	path      string
@@ -20,71 +46,647 @@ type node[T any] struct {
 	parent    *node[T]
 	children  map[rune]*node[T]
 	termCount int
+	hasMeta   bool
+	deleted   bool
+	// gen is the write that created the node; see Trie.own.
+	gen uint64
 }
 
+// Trie is safe for concurrent use. Reads share a sync.RWMutex and
+// writes hold it exclusively, except that Find and PrefixSearch take no
+// lock on a trie created WithLockFreeReads.
 type Trie[T any] struct {
-	mu   sync.RWMutex
-	root *node[T]
-	size int
+	mu     sync.RWMutex
+	frozen atomic.Bool
+	root   *node[T]
+	size   int
+	fold   func(rune) rune
+
+	// published is root as of the last write to finish, for the reads
+	// that take no lock under WithLockFreeReads. gen numbers the write
+	// in progress.
+	published atomic.Pointer[node[T]]
+	gen       uint64
+
+	nodes       int
+	maxNodes    int
+	nodePaths   bool
+	weightBlend float64
+	observer    Observer
+	newMeta     func(prefix string) T
+	keysOnly    bool
+	lockFree    bool
+	decode      func([]byte) []rune
+	misses      *missCache
+	tags        map[string]map[*node[T]]struct{}
+
+	// collMu serializes calls to collator. Tries copied by Map and
+	// Filter share both, and so the same lock.
+	collMu   *sync.Mutex
+	collator Collator
+
+	wal        io.Writer
+	walErr     error
+	encodeMeta func(T) []byte
+}
+
+// Collator compares strings according to locale-specific rules. It is
+// satisfied by *collate.Collator from golang.org/x/text/collate.
+type Collator interface {
+	CompareString(a, b string) int
 }
 
+// Option configures optional behaviour of a Trie created by New.
+type Option[T any] func(*Trie[T])
+
+// ByKeys orders keys by length in runes, breaking ties lexically.
 type ByKeys []string
 
-func (a ByKeys) Len() int           { return len(a) }
-func (a ByKeys) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
-func (a ByKeys) Less(i, j int) bool { return len(a[i]) < len(a[j]) }
+func (a ByKeys) Len() int      { return len(a) }
+func (a ByKeys) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a ByKeys) Less(i, j int) bool {
+	if li, lj := utf8.RuneCountInString(a[i]), utf8.RuneCountInString(a[j]); li != lj {
+		return li < lj
+	}
+	return a[i] < a[j]
+}
 
 const nul = 0x0
 
 // New creates a new Trie with an initialized root Node.
-func New[T any]() *Trie[T] {
-	return &Trie[T]{
-		root: &node[T]{children: make(map[rune]*node[T]), depth: 0},
-		size: 0,
+func New[T any](opts ...Option[T]) *Trie[T] {
+	t := newTrie(opts...)
+	t.publish()
+	return t
+}
+
+// newTrie is New without publishing the root, so that the caller can
+// go on filling the trie in place before handing it out.
+func newTrie[T any](opts ...Option[T]) *Trie[T] {
+	t := &Trie[T]{
+		root:        &node[T]{children: make(map[rune]*node[T]), depth: 0},
+		size:        0,
+		weightBlend: defaultWeightBlend,
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	return t
+}
+
+// NewWithCapacity creates a new Trie sized for roughly expectedKeys
+// keys. The hint is advisory: it presizes the root's children, which
+// are the keys' distinct first runes, for at most an alphabet's worth
+// of them, and the trie grows past it as needed.
+func NewWithCapacity[T any](expectedKeys int, opts ...Option[T]) *Trie[T] {
+	t := newWithCapacity(expectedKeys, opts...)
+	t.publish()
+	return t
+}
+
+// newWithCapacity is NewWithCapacity without publishing the root.
+func newWithCapacity[T any](expectedKeys int, opts ...Option[T]) *Trie[T] {
+	t := newTrie(opts...)
+	t.root.children = make(map[rune]*node[T], min(max(expectedKeys, 0), maxRootCapacity))
+	return t
+}
+
+// FromMap creates a new Trie holding every entry of m. A trie's shape
+// depends only on the keys it stores, so the random order in which the
+// map is iterated does not matter, except that which entries are left
+// out when a WithMaxNodes cap is reached is arbitrary.
+func FromMap[T any](m map[string]T, opts ...Option[T]) *Trie[T] {
+	t := newWithCapacity(len(m), opts...)
+	for key, meta := range m {
+		t.add(key, meta)
+	}
+	t.publish()
+	return t
+}
+
+// maxRootCapacity bounds the capacity hint given to the root's children.
+// They are distinct first runes, which for most keys come from an
+// alphabet of letters in both cases and digits.
+const maxRootCapacity = 64
+
+// BuildParallel builds a trie from keys, where metas[i] is the meta
+// data of keys[i], using up to shards goroutines. Keys are partitioned
+// by their first rune, so every shard builds disjoint root subtrees that
+// are then moved under a single root without any locking. It panics if
+// keys and metas differ in length.
+func BuildParallel[T any](keys []string, metas []T, shards int) *Trie[T] {
+	if len(keys) != len(metas) {
+		panic("trie: BuildParallel needs one meta per key")
+	}
+	shards = max(shards, 1)
+
+	parts := make([][]int, shards)
+	for i, key := range keys {
+		var first rune
+		for _, r := range key {
+			first = r
+			break
+		}
+		s := int(uint32(first) % uint32(shards))
+		parts[s] = append(parts[s], i)
+	}
+
+	built := make([]*Trie[T], shards)
+	var wg sync.WaitGroup
+	for s := range parts {
+		wg.Add(1)
+		go func(s int) {
+			defer wg.Done()
+			sub := newTrie[T]()
+			for _, i := range parts[s] {
+				sub.add(keys[i], metas[i])
+			}
+			built[s] = sub
+		}(s)
+	}
+	wg.Wait()
+
+	t := newTrie[T]()
+	for _, sub := range built {
+		for _, c := range sub.root.appendChildren(nil) {
+			c.parent = t.root
+			t.root.setChild(c)
+		}
+		t.root.mask |= sub.root.mask
+		t.root.termCount += sub.root.termCount
+		t.size += sub.size
+		t.nodes += sub.nodes
+	}
+	t.publish()
+	return t
+}
+
+// Map returns a new trie with the keys of t and their meta data passed
+// through f. The nodes are copied rather than re-added. The new trie
+// keeps the options Filter keeps, apart from WithIntermediateMeta,
+// whose function makes meta data of t's type, and leaves out the same
+// miss cache, tags and write-ahead log. Under WithKeysOnly f is not
+// called.
+func Map[A, B any](t *Trie[A], f func(A) B) *Trie[B] {
+	defer t.runlock(t.rlock())
+
+	if t.keysOnly {
+		f = func(A) B {
+			var zero B
+			return zero
+		}
+	}
+	m := &Trie[B]{
+		size:        t.size,
+		fold:        t.fold,
+		nodes:       t.nodes,
+		maxNodes:    t.maxNodes,
+		nodePaths:   t.nodePaths,
+		weightBlend: t.weightBlend,
+		observer:    t.observer,
+		keysOnly:    t.keysOnly,
+		decode:      t.decode,
+		collMu:      t.collMu,
+		collator:    t.collator,
+		lockFree:    t.lockFree,
+	}
+	m.root = mapNode[A, B](t.root, nil, f)
+
+	type pair struct {
+		from *node[A]
+		to   *node[B]
+	}
+	stack := []pair{{t.root, m.root}}
+	for len(stack) > 0 {
+		i := len(stack) - 1
+		p := stack[i]
+		stack = stack[:i]
+		p.from.eachChild(func(c *node[A]) bool {
+			mc := mapNode(c, p.to, f)
+			p.to.setChild(mc)
+			stack = append(stack, pair{c, mc})
+			return true
+		})
+	}
+	m.publish()
+	return m
+}
+
+// Filter returns a new trie holding the keys of t, with their meta
+// data, for which keep returns true. The new trie keeps every option t
+// was created with, its observer included, apart from its miss cache,
+// and like Map leaves out its tags and write-ahead log. Both tries call
+// a collator under one lock. keep is called with t's read lock held
+// and must not call back into t.
+func Filter[T any](t *Trie[T], keep func(key string, meta T) bool) *Trie[T] {
+	defer t.runlock(t.rlock())
+
+	f := &Trie[T]{
+		root:        &node[T]{children: make(map[rune]*node[T])},
+		fold:        t.fold,
+		maxNodes:    t.maxNodes,
+		nodePaths:   t.nodePaths,
+		weightBlend: t.weightBlend,
+		collMu:      t.collMu,
+		collator:    t.collator,
+		observer:    t.observer,
+		newMeta:     t.newMeta,
+		keysOnly:    t.keysOnly,
+		decode:      t.decode,
+		lockFree:    t.lockFree,
+	}
+	eachTerminal(t.root, func(n *node[T]) bool {
+		if keep(n.path, n.meta) {
+			f.add(n.path, n.meta)
+		}
+		return true
+	})
+	f.publish()
+	return f
+}
+
+// WithDiacriticFolding makes FuzzySearch ignore diacritics and case, so
+// that "jose" matches "José". Keys are still returned as they were
+// added.
+func WithDiacriticFolding[T any]() Option[T] {
+	return func(t *Trie[T]) {
+		t.addFold(foldDiacritic)
+	}
+}
+
+// WithRuneTransform makes FuzzySearch compare runes after mapping both
+// the stored keys and the query through transform, for instance to
+// transliterate Cyrillic to Latin. Keys are still returned as they were
+// added. Combined with WithDiacriticFolding, or another transform, the
+// mappings apply in the order the options are given.
+func WithRuneTransform[T any](transform func(rune) rune) Option[T] {
+	return func(t *Trie[T]) {
+		t.addFold(transform)
+	}
+}
+
+// WithByteDecoder sets how AddBytes and FindBytes turn byte keys into
+// runes, for keys in encodings other than UTF-8 such as Latin-1. Keys
+// are stored as the decoded runes, so Keys and PrefixSearch return them
+// as UTF-8. Without it byte keys are decoded as UTF-8.
+func WithByteDecoder[T any](decode func([]byte) []rune) Option[T] {
+	return func(t *Trie[T]) {
+		t.decode = decode
+	}
+}
+
+// WithCollator orders the results of Keys and PrefixSearch with c
+// instead of leaving them unordered, and breaks ties between keys of
+// equal length in FuzzySearch with c rather than by byte order. Calls
+// to c are serialized, so collators that are not safe for concurrent
+// use, like *collate.Collator, may be used.
+func WithCollator[T any](c Collator) Option[T] {
+	return func(t *Trie[T]) {
+		t.collator = c
+		t.collMu = new(sync.Mutex)
+	}
+}
+
+// WithNodePaths records the running prefix on intermediate nodes as
+// well as on keys, so debugging tools can show the path of any node.
+// Each intermediate node then holds its own copy of its prefix, which
+// costs memory quadratic in key length along unshared branches.
+func WithNodePaths[T any]() Option[T] {
+	return func(t *Trie[T]) {
+		t.nodePaths = true
+	}
+}
+
+// WithLockFreeReads makes Find and PrefixSearch take no lock. They walk
+// the root published by the last write to finish. A write copies each
+// node it changes, along with the path from that node to the root, and
+// publishes the new root atomically as it releases the lock. The only
+// field a write changes on a published node is its parent pointer,
+// which those reads never follow.
+//
+// The price is paid in memory and allocation by writes, which suits
+// tries that are built once and then mostly read. Every write allocates
+// a copy of the nodes on the path to the key it changes, children
+// included, so writing beneath a node with many children copies all of
+// them; the old nodes become garbage once no reader is still walking
+// them. Each, RecomputeMasks, ShrinkToFit and Freeze may change any
+// node, so they copy the whole trie. A node returned by Find or any
+// other method is a snapshot that a later write to its key replaces
+// rather than updates, so that Meta and MetaPtr then see the old meta
+// data. A lock-free read racing a write sees the trie as it was before
+// that write. Find still takes the lock on a trie also created
+// WithMissCache, whose cache has to stay in step with writes.
+func WithLockFreeReads[T any]() Option[T] {
+	return func(t *Trie[T]) {
+		t.lockFree = true
+	}
+}
+
+// WithMissCache makes Find remember up to size recently looked up keys
+// that were not found, so that repeated misses skip the walk. Adding a
+// key evicts it from the cache.
+func WithMissCache[T any](size int) Option[T] {
+	return func(t *Trie[T]) {
+		if size > 0 {
+			t.misses = newMissCache(size)
+		}
+	}
+}
+
+// WithWeightBlend sets how much FuzzySearchWeighted favours the weight
+// of a key's meta data over the quality of its match, from 0 (match
+// quality only) to 1 (weight only). It defaults to 0.5.
+func WithWeightBlend[T any](blend float64) Option[T] {
+	return func(t *Trie[T]) {
+		t.weightBlend = min(max(blend, 0), 1)
+	}
+}
+
+const defaultWeightBlend = 0.5
+
+// WithIntermediateMeta makes Add attach newMeta(prefix) as prefix meta
+// data, as SetPrefixMeta would, to every intermediate node it creates,
+// so that GetPrefixMeta finds it for any prefix of a stored key.
+func WithIntermediateMeta[T any](newMeta func(prefix string) T) Option[T] {
+	return func(t *Trie[T]) {
+		t.newMeta = newMeta
+	}
+}
+
+// WithKeysOnly makes the trie discard the meta data of added keys, for
+// callers that only ask which keys are stored, so that meta data
+// holding pointers keeps nothing alive. Meta data given to UpdateMetas,
+// SetPrefixMeta, WithIntermediateMeta or written through Each is
+// discarded the same way; only MetaPtr, which bypasses the trie, can
+// still store some. The meta field itself remains;
+// a Trie[struct{}] is the way to have it take no space at all, and its
+// meta data never needs to be discarded.
+func WithKeysOnly[T any]() Option[T] {
+	return func(t *Trie[T]) {
+		t.keysOnly = true
+	}
+}
+
+// WithMaxNodes caps the number of nodes the trie may hold, counting one
+// per rune of a stored path plus one per key. An Add that would need
+// more nodes than the cap allows fails and returns nil.
+func WithMaxNodes[T any](max int) Option[T] {
+	return func(t *Trie[T]) {
+		t.maxNodes = max
+	}
+}
+
+// ErrNodeLimit is returned by AddValidated, ReadFrom and ReplayWAL when
+// a key cannot be added without exceeding the cap set by WithMaxNodes.
+var ErrNodeLimit = errors.New("trie: node limit reached")
+
+// Observer receives a call after each Add, Find, Remove, PrefixSearch,
+// FuzzySearch and Search on a trie created WithObserver, with how long
+// the call took, including any wait for the lock. Calls are made once
+// the lock has been released, from the goroutine that made the call,
+// so an Observer shared by goroutines must be safe for concurrent use.
+type Observer interface {
+	ObserveAdd(dur time.Duration)
+	ObserveFind(hit bool, dur time.Duration)
+	ObserveRemove(found bool, dur time.Duration)
+	// ObserveSearch is called with the name of the search method and
+	// the number of keys it returned.
+	ObserveSearch(method string, results int, dur time.Duration)
+}
+
+// WithObserver reports the trie's operations to o.
+func WithObserver[T any](o Observer) Option[T] {
+	return func(t *Trie[T]) {
+		t.observer = o
 	}
 }
 
 // Add adds the key to the Trie, including meta data. Meta data
 // is stored as `interface{}` and must be type cast by
-// the caller.
+// the caller. It returns nil if the trie was created WithMaxNodes and
+// the key would not fit.
 func (t *Trie[T]) Add(key string, meta T) *node[T] {
-	t.mu.Lock()
-	defer t.mu.Unlock()
+	if t.observer != nil {
+		defer t.observeAdd(time.Now())
+	}
+	t.lock()
+	defer t.unlock()
 
-	t.size++
+	return t.add(key, meta)
+}
+
+// AddWith is Add except that when key is already stored, its meta data
+// becomes combine(old, meta) instead of meta. combine is called with the
+// write lock held and must not call back into the trie.
+func (t *Trie[T]) AddWith(key string, meta T, combine func(old, new T) T) *node[T] {
+	t.lock()
+	defer t.unlock()
+
+	if n, ok := t.find(key); ok {
+		meta = combine(n.meta, meta)
+	}
+	return t.add(key, meta)
+}
+
+// ErrInvalidUTF8 is returned by AddValidated for keys that are not
+// valid UTF-8.
+var ErrInvalidUTF8 = errors.New("trie: key is not valid UTF-8")
+
+// AddValidated is Add for keys from untrusted input. Add walks the
+// malformed bytes of a key as utf8.RuneError, so distinct invalid keys
+// collide; AddValidated rejects them with ErrInvalidUTF8 instead.
+// It returns ErrNodeLimit when the key does not fit a WithMaxNodes cap.
+func (t *Trie[T]) AddValidated(key string, meta T) (*node[T], error) {
+	if !utf8.ValidString(key) {
+		return nil, ErrInvalidUTF8
+	}
+
+	t.lock()
+	defer t.unlock()
+
+	n := t.add(key, meta)
+	if n == nil {
+		return nil, ErrNodeLimit
+	}
+	return n, nil
+}
+
+// storedMeta returns the meta data to store for meta: meta itself, or
+// the zero value under WithKeysOnly.
+func (t *Trie[T]) storedMeta(meta T) T {
+	if t.keysOnly {
+		var zero T
+		return zero
+	}
+	return meta
+}
+
+// add inserts key without taking the lock. Re-adding an existing key
+// only replaces its meta data so that size and termCount stay exact.
+func (t *Trie[T]) add(key string, meta T) *node[T] {
+	meta = t.storedMeta(meta)
 	runes := []rune(key)
-	bitmask := maskruneslice(runes)
-	nd := t.root
-	nd.mask |= bitmask
+	if nd := findNode(t.root, runes); nd != nil {
+		if n, ok := nd.Child(nul); ok && n.term {
+			t.logWAL(walAdd, key, meta)
+			n = t.own(n)
+			n.meta = meta
+			return n
+		} else if ok && n.deleted {
+			n = t.own(n)
+			n.meta = meta
+			t.revive(n)
+			return n
+		}
+	}
+
+	// The key needs a node for each rune past the longest stored
+	// prefix, plus its terminal.
+	need := 1
+	if t.maxNodes > 0 {
+		nd := t.root
+		for i, r := range runes {
+			n, ok := nd.Child(r)
+			if !ok {
+				need += len(runes) - i
+				break
+			}
+			nd = n
+		}
+		if t.nodes+need > t.maxNodes {
+			return nil
+		}
+	}
+
+	t.logWAL(walAdd, key, meta)
+	if t.misses != nil {
+		t.misses.remove(key)
+	}
+	t.size++
+	// masks[i] is the mask of runes[i:], built back to front so that
+	// long keys are not rescanned at every level.
+	masks := make([]uint64, len(runes)+1)
+	for i := len(runes) - 1; i >= 0; i-- {
+		masks[i] = masks[i+1] | t.maskruneslice(runes[i:i+1])
+	}
+
+	nd := t.own(t.root)
+	nd.mask |= masks[0]
 	nd.termCount++
 	for i := range runes {
 		r := runes[i]
-		bitmask = maskruneslice(runes[i:])
-		if n, ok := nd.children[r]; ok {
-			nd = n
+		bitmask := masks[i]
+		if n, ok := nd.Child(r); ok {
+			nd = t.own(n)
 			nd.mask |= bitmask
 		} else {
-			nd = nd.newEmptyChild(r, "", bitmask)
+			var path string
+			if t.nodePaths {
+				path = string(runes[:i+1])
+			}
+			nd = nd.newEmptyChild(r, path, bitmask)
+			if t.newMeta != nil {
+				nd.meta, nd.hasMeta = t.storedMeta(t.newMeta(string(runes[:i+1]))), true
+			}
+			t.nodes++
 		}
 		nd.termCount++
 	}
 	nd = nd.newChild(nul, key, 0, meta, true)
+	t.nodes++
 
 	return nd
 }
 
+// AddBytes is Add for a key given as bytes, decoded with the
+// WithByteDecoder function or as UTF-8 by default.
+func (t *Trie[T]) AddBytes(key []byte, meta T) *node[T] {
+	return t.Add(t.decodeBytes(key), meta)
+}
+
+// FindBytes is Find for a key given as bytes, decoded as in AddBytes.
+func (t *Trie[T]) FindBytes(key []byte) (*node[T], bool) {
+	return t.Find(t.decodeBytes(key))
+}
+
+func (t *Trie[T]) decodeBytes(key []byte) string {
+	if t.decode == nil {
+		return string(key)
+	}
+	return string(t.decode(key))
+}
+
 // Find finds and returns meta data associated
 // with `key`.
-func (t *Trie[T]) Find(key string) (*node[T], bool) {
-	t.mu.RLock()
-	defer t.mu.RUnlock()
+func (t *Trie[T]) Find(key string) (n *node[T], ok bool) {
+	if t.observer != nil {
+		defer t.observeFind(time.Now(), &ok)
+	}
+	if t.lockFree && t.misses == nil {
+		return findKey(t.published.Load(), key)
+	}
+	defer t.runlock(t.rlock())
 
-	nd := findNode(t.root, []rune(key))
+	if t.misses == nil {
+		return t.find(key)
+	}
+	if t.misses.contains(key) {
+		return nil, false
+	}
+	n, ok = t.find(key)
+	if !ok {
+		t.misses.add(key)
+	}
+	return n, ok
+}
+
+// FindAll returns the meta data of every key in keys that is stored in
+// the trie, taking the read lock only once. Absent keys are omitted.
+func (t *Trie[T]) FindAll(keys []string) map[string]T {
+	defer t.runlock(t.rlock())
+
+	found := make(map[string]T)
+	for _, key := range keys {
+		if n, ok := t.find(key); ok {
+			found[key] = n.meta
+		}
+	}
+	return found
+}
+
+// Contains reports whether key is stored in the trie. Unlike Find it
+// neither returns the key's node nor consults the miss cache.
+func (t *Trie[T]) Contains(key string) bool {
+	defer t.runlock(t.rlock())
+
+	_, ok := t.find(key)
+	return ok
+}
+
+// ContainsAll is Contains for each of keys, taking the read lock only
+// once. The result is parallel to keys.
+func (t *Trie[T]) ContainsAll(keys []string) []bool {
+	defer t.runlock(t.rlock())
+
+	found := make([]bool, len(keys))
+	for i, key := range keys {
+		_, found[i] = t.find(key)
+	}
+	return found
+}
+
+func (t *Trie[T]) find(key string) (*node[T], bool) {
+	return findKey(t.root, key)
+}
+
+// findKey returns the terminal of key beneath root.
+func findKey[T any](root *node[T], key string) (*node[T], bool) {
+	nd := findNode(root, []rune(key))
 	if nd == nil {
 		return nil, false
 	}
 
-	nd, ok := nd.children[nul]
+	nd, ok := nd.Child(nul)
 	if !ok || !nd.term {
 		return nil, false
 	}
@@ -93,163 +695,2411 @@ func (t *Trie[T]) Find(key string) (*node[T], bool) {
 }
 
 func (t *Trie[T]) HasKeysWithPrefix(key string) bool {
-	t.mu.RLock()
-	defer t.mu.RUnlock()
+	defer t.runlock(t.rlock())
 
 	nd := findNode(t.root, []rune(key))
-	return nd != nil
+	return nd != nil && nd.termCount > 0
+}
+
+// HasKeyOrPrefix reports whether s is a stored key or a prefix of one.
+// A key counts among the keys with itself as a prefix, so it is the
+// same as HasKeysWithPrefix.
+func (t *Trie[T]) HasKeyOrPrefix(s string) bool {
+	return t.HasKeysWithPrefix(s)
+}
+
+// UpdateMetas replaces the meta data of every key in updates that is
+// stored in the trie, under a single write lock, and reports how many
+// it replaced. Keys that are not stored are skipped rather than added.
+func (t *Trie[T]) UpdateMetas(updates map[string]T) int {
+	t.lock()
+	defer t.unlock()
+
+	applied := 0
+	for key, meta := range updates {
+		if n, ok := t.find(key); ok {
+			meta = t.storedMeta(meta)
+			t.logWAL(walAdd, key, meta)
+			n = t.own(n)
+			n.meta = meta
+			applied++
+		}
+	}
+	return applied
 }
 
 // Remove removes a key from the trie, ensuring that
 // all bitmasks up to root are appropriately recalculated.
 func (t *Trie[T]) Remove(key string) {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-
-	var (
-		rs = []rune(key)
-		nd = findNode(t.root, []rune(key))
-	)
+	var found bool
+	if t.observer != nil {
+		defer t.observeRemove(time.Now(), &found)
+	}
+	t.lock()
+	defer t.unlock()
 
+	nd := findNode(t.root, []rune(key))
 	if nd == nil {
 		return
 	}
 
-	t.size--
-	for n := nd.parent; n != nil; n = n.parent {
-		if n == t.root {
-			t.root = &node[T]{children: make(map[rune]*node[T])}
-			break
-		}
-
-		if len(n.children) > 1 {
-			n.removeChild(rs[n.depth])
-			break
-		}
+	n, ok := nd.Child(nul)
+	if !ok || !n.term {
+		return
 	}
+	t.removeTerminal(n)
+	found = true
 }
 
-// Keys returns all the keys currently stored in the trie.
-func (t *Trie[T]) Keys() []string {
-	t.mu.RLock()
-	defer t.mu.RUnlock()
+// SetTerminal makes the node at `key`, which must already exist as a
+// key or a prefix of one, end a key with meta data meta when term is
+// set, and stop ending one when it is not, in which case meta is
+// unused. It reports whether the node existed; promoting a prefix also
+// fails if it would exceed a WithMaxNodes cap.
+func (t *Trie[T]) SetTerminal(key string, term bool, meta T) bool {
+	t.lock()
+	defer t.unlock()
 
-	if t.size == 0 {
-		return []string{}
+	if findNode(t.root, []rune(key)) == nil {
+		return false
 	}
-
-	return t.PrefixSearch("")
-}
-
-// FuzzySearch performs a fuzzy search against the keys in the trie.
-func (t *Trie[T]) FuzzySearch(pre string) []string {
-	t.mu.RLock()
-	defer t.mu.RUnlock()
-
-	keys := fuzzycollect(t.root, []rune(pre))
-	sort.Sort(ByKeys(keys))
-	return keys
+	if term {
+		return t.add(key, meta) != nil
+	}
+	if n, ok := t.find(key); ok {
+		t.removeTerminal(n)
+	}
+	return true
 }
 
-// PrefixSearch performs a prefix search against the keys in the trie.
-func (t *Trie[T]) PrefixSearch(pre string) []string {
-	t.mu.RLock()
-	defer t.mu.RUnlock()
+// Pop removes key from the trie and returns its meta data, reporting
+// whether the key was present.
+func (t *Trie[T]) Pop(key string) (T, bool) {
+	t.lock()
+	defer t.unlock()
 
-	nd := findNode(t.root, []rune(pre))
+	var meta T
+	nd := findNode(t.root, []rune(key))
 	if nd == nil {
-		return nil
+		return meta, false
 	}
 
-	return collect(nd)
-}
-
-// newChild creates and returns a pointer to a new child for the node.
-func (n *node[T]) newChild(val rune, path string, bitmask uint64, meta T, term bool) *node[T] {
-	node := &node[T]{
-		val:      val,
-		path:     path,
-		mask:     bitmask,
-		term:     term,
-		meta:     meta,
-		parent:   n,
-		children: make(map[rune]*node[T]),
-		depth:    n.depth + 1,
+	n, ok := nd.Child(nul)
+	if !ok || !n.term {
+		return meta, false
 	}
-	n.children[node.val] = node
-	n.mask |= bitmask
-	return node
+	meta = n.meta
+	t.removeTerminal(n)
+	return meta, true
 }
 
-// newEmptyChild creates and returns a pointer to a new child for the node.
-func (n *node[T]) newEmptyChild(val rune, path string, bitmask uint64) *node[T] {
-	node := &node[T]{
-		val:      val,
-		path:     path,
-		mask:     bitmask,
-		parent:   n,
-		children: make(map[rune]*node[T]),
-		depth:    n.depth + 1,
-	}
-	n.children[node.val] = node
-	n.mask |= bitmask
-	return node
-}
+// RemoveIf removes every key for which pred returns true and reports
+// how many were removed. pred is called with the write lock held and
+// must not call back into the trie.
+func (t *Trie[T]) RemoveIf(pred func(key string, meta T) bool) int {
+	t.lock()
+	defer t.unlock()
 
-func (n *node[T]) removeChild(r rune) {
-	delete(n.children, r)
-	for nd := n.parent; nd != nil; nd = nd.parent {
-		nd.mask ^= nd.mask
-		nd.mask |= uint64(1) << uint64(nd.val-'a')
-		for _, c := range nd.children {
-			nd.mask |= c.mask
+	var doomed []*node[T]
+	eachTerminal(t.root, func(n *node[T]) bool {
+		if pred(n.path, n.meta) {
+			doomed = append(doomed, n)
 		}
+		return true
+	})
+
+	for _, n := range doomed {
+		t.removeTerminal(n)
 	}
+	return len(doomed)
 }
 
-func findNode[T any](nd *node[T], runes []rune) *node[T] {
+// RemovePrefixKeys removes every key that starts with `pre` and returns
+// the keys it removed, in no particular order. The node for `pre` is
+// detached whole, so keys soft-deleted beneath it go as well.
+func (t *Trie[T]) RemovePrefixKeys(pre string) []string {
+	t.lock()
+	defer t.unlock()
+
+	nd := findNode(t.root, []rune(pre))
 	if nd == nil {
 		return nil
 	}
 
-	if len(runes) == 0 {
-		return nd
+	keys := []string{}
+	var gone []*node[T]
+	count := 0
+	nodes := []*node[T]{nd}
+	for len(nodes) > 0 {
+		i := len(nodes) - 1
+		n := nodes[i]
+		nodes = n.appendChildren(nodes[:i])
+		count++
+		if n.term {
+			keys = append(keys, n.path)
+		}
+		if n.term || n.deleted {
+			gone = append(gone, n)
+		}
 	}
-
-	n, ok := nd.children[runes[0]]
-	if !ok {
-		return nil
+	if len(keys) == 0 {
+		return keys
 	}
-
-	var nrunes []rune
-	if len(runes) > 1 {
-		nrunes = runes[1:]
-	} else {
-		nrunes = runes[0:0]
+	for _, n := range gone {
+		if n.term {
+			t.logWAL(walRemove, n.path, n.meta)
+		}
+		t.untag(n)
 	}
+	t.size -= len(keys)
 
-	return findNode(n, nrunes)
-}
+	if nd == t.root {
+		root := t.own(nd)
+		root.children = make(map[rune]*node[T])
+		root.mask = t.maskruneslice([]rune{root.val})
+		root.termCount = 0
+		t.nodes = 0
+		return keys
+	}
 
-func maskruneslice(rs []rune) uint64 {
-	var m uint64
-	for _, r := range rs {
-		m |= uint64(1) << uint64(r-'a')
+	// Detach nd along with the ancestors that only led to it, fixing up
+	// termCounts and bitmasks on the way to the root.
+	for p := t.own(nd.parent); p != nil; p = p.parent {
+		p.termCount -= len(keys)
 	}
-	return m
+	top, r := nd.parent, nd.val
+	for top != t.root && top.numChildren() == 1 {
+		top, r = top.parent, top.val
+	}
+	t.nodes -= count + nd.depth - top.depth - 1
+	t.removeChild(top, r)
+	return keys
 }
 
-func collect[T any](nd *node[T]) []string {
-	keys := make([]string, 0, nd.termCount)
-	nodes := make([]*node[T], 1, len(nd.children)+1)
-	nodes[0] = nd
+// rebuildFraction is the share of its keys past which
+// RemoveAllAndRebuild copies the keys that remain into fresh nodes
+// rather than removing keys one at a time.
+const rebuildFraction = 0.9
+
+// RemoveAllAndRebuild removes keys from the trie, ignoring those it
+// does not hold. When the keys it holds are more than rebuildFraction
+// of all its keys, the remaining keys are instead copied into fresh
+// nodes. That replaces every node, so nodes returned earlier by Find
+// and similar methods no longer belong to the trie, and it drops
+// soft-deleted keys as PurgeTombstones would. Tags of the remaining
+// keys are kept either way.
+func (t *Trie[T]) RemoveAllAndRebuild(keys []string) {
+	t.lock()
+	defer t.unlock()
+
+	if float64(len(keys)) <= rebuildFraction*float64(t.size) {
+		for _, key := range keys {
+			if n, ok := t.find(key); ok {
+				t.removeTerminal(n)
+			}
+		}
+		return
+	}
+
+	// Sort the stored keys into those going and those staying in one
+	// walk. Only keys actually stored count towards the threshold.
+	doomed := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		doomed[key] = struct{}{}
+	}
+	var gone, remain []*node[T]
+	eachTerminal(t.root, func(n *node[T]) bool {
+		if _, ok := doomed[n.path]; ok {
+			gone = append(gone, n)
+		} else {
+			remain = append(remain, n)
+		}
+		return true
+	})
+	if float64(len(gone)) <= rebuildFraction*float64(t.size) {
+		for _, n := range gone {
+			t.removeTerminal(n)
+		}
+		return
+	}
+	for _, n := range gone {
+		t.logWAL(walRemove, n.path, n.meta)
+	}
+
+	// Copy each remaining key's path, stopping at the first node
+	// already copied, then count the key and its runes on the way up.
+	root := &node[T]{children: make(map[rune]*node[T])}
+	copies := map[*node[T]]*node[T]{t.root: root}
+	moved := make(map[*node[T]]*node[T], len(t.tags))
+	t.size, t.nodes = 0, 0
+	var path []*node[T]
+	for _, n := range remain {
+		path = path[:0]
+		p := n
+		for ; copies[p] == nil; p = p.parent {
+			path = append(path, p)
+		}
+		c := copies[p]
+		for i := len(path) - 1; i >= 0; i-- {
+			o := path[i]
+			cc := &node[T]{
+				val:      o.val,
+				path:     o.path,
+				term:     o.term,
+				depth:    o.depth,
+				meta:     o.meta,
+				parent:   c,
+				children: make(map[rune]*node[T]),
+				hasMeta:  o.hasMeta,
+			}
+			c.setChild(cc)
+			if !o.term {
+				copies[o] = cc
+			}
+			t.nodes++
+			c = cc
+		}
+		t.size++
+		if t.tags != nil {
+			moved[n] = c
+		}
+		var mask uint64
+		for a := c.parent; a != nil; a = a.parent {
+			a.termCount++
+			mask |= t.maskruneslice([]rune{a.val})
+			a.mask |= mask
+		}
+	}
+	t.root = root
+
+	for tag, nodes := range t.tags {
+		kept := make(map[*node[T]]struct{}, len(nodes))
+		for n := range nodes {
+			if nn, ok := moved[n]; ok {
+				kept[nn] = struct{}{}
+			}
+		}
+		if len(kept) == 0 {
+			delete(t.tags, tag)
+		} else {
+			t.tags[tag] = kept
+		}
+	}
+}
+
+// Keys returns all the keys currently stored in the trie.
+func (t *Trie[T]) Keys() []string {
+	defer t.runlock(t.rlock())
+
+	if t.size == 0 {
+		return []string{}
+	}
+
+	return t.prefixSearch("")
+}
+
+// KeysBFS returns all the keys walking the trie breadth first, so keys
+// come out grouped by length in runes, shortest first, without sorting.
+// The order within a group is unspecified.
+func (t *Trie[T]) KeysBFS() []string {
+	defer t.runlock(t.rlock())
+
+	keys := make([]string, 0, t.size)
+	queue := []*node[T]{t.root}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		if n.term {
+			keys = append(keys, n.path)
+		}
+		queue = n.appendChildren(queue)
+	}
+	return keys
+}
+
+// FuzzySearch performs a fuzzy search against the keys in the trie.
+func (t *Trie[T]) FuzzySearch(pre string) (keys []string) {
+	if t.observer != nil {
+		defer t.observeSearch("FuzzySearch", time.Now(), &keys)
+	}
+	defer t.runlock(t.rlock())
+
+	return t.fuzzySearch(pre)
+}
+
+// PrefixSearch performs a prefix search against the keys in the trie.
+func (t *Trie[T]) PrefixSearch(pre string) (keys []string) {
+	if t.observer != nil {
+		defer t.observeSearch("PrefixSearch", time.Now(), &keys)
+	}
+	if t.lockFree {
+		return t.prefixSearchIn(t.published.Load(), pre)
+	}
+	defer t.runlock(t.rlock())
+
+	return t.prefixSearch(pre)
+}
+
+// StreamPrefix writes the keys starting with `pre` to w as they are
+// found, separated by sep, and returns the number of keys written.
+// Nothing is buffered, so keys come out in no particular order. The
+// first write error aborts the walk and is returned. The read lock is
+// held until the walk ends, so a slow writer stalls writers to the trie.
+func (t *Trie[T]) StreamPrefix(w io.Writer, pre, sep string) (int, error) {
+	defer t.runlock(t.rlock())
+
+	nd := findNode(t.root, []rune(pre))
+	if nd == nil {
+		return 0, nil
+	}
+
+	var (
+		count int
+		err   error
+	)
+	eachTerminal(nd, func(n *node[T]) bool {
+		if count > 0 {
+			if _, err = io.WriteString(w, sep); err != nil {
+				return false
+			}
+		}
+		if _, err = io.WriteString(w, n.path); err != nil {
+			return false
+		}
+		count++
+		return true
+	})
+	return count, err
+}
+
+// Search is a single entry point for search boxes. Queries containing
+// runes absent from every key are rejected using the root bitmask
+// without walking the trie. A query that is a prefix of stored keys
+// returns those completions; anything else falls back to FuzzySearch.
+// Results are ordered by key length either way.
+func (t *Trie[T]) Search(q string) (keys []string) {
+	if t.observer != nil {
+		defer t.observeSearch("Search", time.Now(), &keys)
+	}
+	defer t.runlock(t.rlock())
+
+	if t.size == 0 {
+		return nil
+	}
+
+	runes := []rune(q)
+	if m := t.maskruneslice(runes); t.root.mask&m != m {
+		return nil
+	}
+
+	if nd := findNode(t.root, runes); nd != nil {
+		keys = collect(nd)
+		t.sortByLength(keys)
+		return keys
+	}
+	return t.fuzzySearch(q)
+}
+
+// GroupByNextRune returns the completions of `pre` bucketed by the
+// rune that immediately follows the prefix. A key equal to `pre` has
+// no next rune and is omitted. Unknown prefixes yield an empty map.
+func (t *Trie[T]) GroupByNextRune(pre string) map[rune][]string {
+	defer t.runlock(t.rlock())
+
+	groups := make(map[rune][]string)
+	nd := findNode(t.root, []rune(pre))
+	if nd == nil {
+		return groups
+	}
+
+	nd.eachChild(func(c *node[T]) bool {
+		if c.val != nul && c.termCount > 0 {
+			groups[c.val] = collect(c)
+		}
+		return true
+	})
+	return groups
+}
+
+// WriteTo serializes every key and its meta data to w, implementing
+// io.WriterTo. The stream is a uvarint record count followed by one
+// record per key: a uvarint-prefixed key and a uvarint-prefixed gob
+// encoding of the meta data. T must therefore be gob encodable.
+func (t *Trie[T]) WriteTo(w io.Writer) (int64, error) {
+	defer t.runlock(t.rlock())
+
+	var nodes []*node[T]
+	eachTerminal(t.root, func(n *node[T]) bool {
+		nodes = append(nodes, n)
+		return true
+	})
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	if err := writeUvarint(bw, uint64(len(nodes))); err != nil {
+		return cw.n, err
+	}
+
+	var buf bytes.Buffer
+	for _, n := range nodes {
+		buf.Reset()
+		if err := gob.NewEncoder(&buf).Encode(&n.meta); err != nil {
+			return cw.n, err
+		}
+		if err := writeChunk(bw, []byte(n.path)); err != nil {
+			return cw.n, err
+		}
+		if err := writeChunk(bw, buf.Bytes()); err != nil {
+			return cw.n, err
+		}
+	}
+
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// ReadFrom adds every record of a stream produced by WriteTo to the
+// trie, implementing io.ReaderFrom. Keys already present are replaced.
+func (t *Trie[T]) ReadFrom(r io.Reader) (int64, error) {
+	cr := &countingReader{r: r}
+	count, err := binary.ReadUvarint(cr)
+	if err != nil {
+		return cr.n, err
+	}
+
+	for i := uint64(0); i < count; i++ {
+		key, err := readChunk(cr)
+		if err != nil {
+			return cr.n, err
+		}
+		raw, err := readChunk(cr)
+		if err != nil {
+			return cr.n, err
+		}
+
+		var meta T
+		if err := gob.NewDecoder(bytes.NewReader(raw)).Decode(&meta); err != nil {
+			return cr.n, err
+		}
+		if t.Add(string(key), meta) == nil {
+			return cr.n, ErrNodeLimit
+		}
+	}
+	return cr.n, nil
+}
+
+// ShortestUniquePrefix returns the shortest prefix of `key` that no
+// other stored key shares. When `key` is itself a prefix of another
+// key the whole key is returned, since only an exact match tells them
+// apart. ok is false if `key` is not stored.
+func (t *Trie[T]) ShortestUniquePrefix(key string) (string, bool) {
+	defer t.runlock(t.rlock())
+
+	runes := []rune(key)
+	nd := findNode(t.root, runes)
+	if nd == nil {
+		return "", false
+	}
+	if n, ok := nd.Child(nul); !ok || !n.term {
+		return "", false
+	}
+
+	nd = t.root
+	for i, r := range runes {
+		nd, _ = nd.Child(r)
+		if nd.termCount == 1 {
+			return string(runes[:i+1]), true
+		}
+	}
+	return key, true
+}
+
+// Each calls fn for every key with a pointer to its meta data, allowing
+// fn to update the meta data in place. The write lock is held for the
+// duration, so fn must not call back into the trie.
+func (t *Trie[T]) Each(fn func(key string, meta *T)) {
+	t.lock()
+	defer t.unlock()
+
+	t.ownEach(func(n *node[T]) {
+		if n.term {
+			fn(n.path, &n.meta)
+			n.meta = t.storedMeta(n.meta)
+		}
+	})
+}
+
+// FuzzySearchContext is FuzzySearch giving up when ctx is done. ctx is
+// checked periodically during the walk, so a query visiting much of the
+// trie stops soon after its deadline rather than running to completion.
+// A search cut short returns ctx.Err() along with the matches found so
+// far, ordered as FuzzySearch orders them; they are a subset of the full
+// result, but not necessarily its first keys.
+func (t *Trie[T]) FuzzySearchContext(ctx context.Context, pre string) ([]string, error) {
+	defer t.runlock(t.rlock())
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var keys []string
+	stop := func() bool { return ctx.Err() != nil }
+	// A match near root, or an empty query, which matches at root, can
+	// hold most of the trie, so the collection polls stop as well.
+	finished := fuzzywalkUntil(t.root, t.foldrunes([]rune(pre)), t.fold, false, stop, func(n *node[T], _ []int) bool {
+		var done bool
+		keys, done = collectUntil(n, keys, stop)
+		return done
+	})
+	t.sortByLength(keys)
+	if !finished {
+		return keys, ctx.Err()
+	}
+	return keys, nil
+}
+
+func (t *Trie[T]) fuzzySearch(pre string) []string {
+	keys := fuzzycollect(t.root, t.foldrunes([]rune(pre)), t.fold)
+	t.sortByLength(keys)
+	return keys
+}
+
+func (t *Trie[T]) prefixSearch(pre string) []string {
+	return t.prefixSearchIn(t.root, pre)
+}
+
+// prefixSearchIn is prefixSearch beneath root, which need not be t's
+// current root.
+func (t *Trie[T]) prefixSearchIn(root *node[T], pre string) []string {
+	nd := findNode(root, []rune(pre))
+	if nd == nil {
+		return []string{}
+	}
+
+	keys := collect(nd)
+	t.collate(keys)
+	return keys
+}
+
+func (t *Trie[T]) editSearch(q []rune, maxDist int) []string {
+	var matches []distMatch
+	editwalk(t.root, q, func(n *node[T], row []int) int {
+		if n.term && row[len(q)] <= maxDist {
+			matches = append(matches, distMatch{n.path, row[len(q)]})
+		}
+		return maxDist
+	})
+	return rankByDistance(matches)
+}
+
+// distMatch is a key found by editSearch or HammingSearch and its
+// distance from the query.
+type distMatch struct {
+	key  string
+	dist int
+}
+
+// rankByDistance returns the keys of matches closest first and
+// lexically among equals.
+func rankByDistance(matches []distMatch) []string {
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].dist != matches[j].dist {
+			return matches[i].dist < matches[j].dist
+		}
+		return matches[i].key < matches[j].key
+	})
+
+	keys := make([]string, len(matches))
+	for i, m := range matches {
+		keys[i] = m.key
+	}
+	return keys
+}
+
+// collate sorts keys with the trie's collator, if it has one.
+func (t *Trie[T]) collate(keys []string) {
+	if t.collator == nil {
+		return
+	}
+
+	t.collMu.Lock()
+	defer t.collMu.Unlock()
+	sort.Slice(keys, func(i, j int) bool {
+		return t.collator.CompareString(keys[i], keys[j]) < 0
+	})
+}
+
+// sortByLength sorts keys as ByKeys does, except that ties are broken
+// with the trie's collator when it has one.
+func (t *Trie[T]) sortByLength(keys []string) {
+	if t.collator == nil {
+		sort.Sort(ByKeys(keys))
+		return
+	}
+
+	t.collMu.Lock()
+	defer t.collMu.Unlock()
+	sort.Slice(keys, func(i, j int) bool { return t.lessByLength(keys[i], keys[j]) })
+}
+
+// lessByLength reports whether key a sorts before key b in the order
+// sortByLength produces. Callers with a collator must hold collMu.
+func (t *Trie[T]) lessByLength(a, b string) bool {
+	if la, lb := utf8.RuneCountInString(a), utf8.RuneCountInString(b); la != lb {
+		return la < lb
+	}
+	if t.collator != nil {
+		return t.collator.CompareString(a, b) < 0
+	}
+	return a < b
+}
+
+// SetPrefixMeta attaches meta data to the node at `pre`, which may be
+// an intermediate node rather than a key. The meta data is kept apart
+// from the meta of a key equal to `pre` and does not make `pre` a key.
+// It is a no-op when no stored key starts with `pre`, and the meta data
+// is discarded once the last key beneath the prefix is removed.
+func (t *Trie[T]) SetPrefixMeta(pre string, meta T) {
+	t.lock()
+	defer t.unlock()
+
+	nd := findNode(t.root, []rune(pre))
+	if nd == nil {
+		return
+	}
+	nd = t.own(nd)
+	nd.meta = t.storedMeta(meta)
+	nd.hasMeta = true
+}
+
+// GetPrefixMeta returns the meta data attached to `pre` by
+// SetPrefixMeta.
+func (t *Trie[T]) GetPrefixMeta(pre string) (T, bool) {
+	defer t.runlock(t.rlock())
+
+	nd := findNode(t.root, []rune(pre))
+	if nd == nil || !nd.hasMeta {
+		var zero T
+		return zero, false
+	}
+	return nd.meta, true
+}
+
+// AncestorMetas returns the meta data of every stored key that is a
+// prefix of `key`, ordered from the shortest to `key` itself when it is
+// stored. Meta data attached with SetPrefixMeta is not included.
+func (t *Trie[T]) AncestorMetas(key string) []T {
+	defer t.runlock(t.rlock())
+
+	var metas []T
+	for _, n := range t.prefixesOf([]rune(key)) {
+		metas = append(metas, n.meta)
+	}
+	return metas
+}
+
+// OrderedPrefixSearch is PrefixSearch returning the completions in
+// ascending lexical order, ignoring any collator. Children are visited
+// in rune order, so the keys come out sorted without a separate sort.
+func (t *Trie[T]) OrderedPrefixSearch(pre string) []string {
+	defer t.runlock(t.rlock())
+
+	nd := findNode(t.root, []rune(pre))
+	if nd == nil {
+		return nil
+	}
+	return collectOrdered(nd, false)
+}
+
+// SortedKeysDesc returns all keys in descending lexical order.
+func (t *Trie[T]) SortedKeysDesc() []string {
+	defer t.runlock(t.rlock())
+
+	return collectOrdered(t.root, true)
+}
+
+// HighlightedMatch is a FuzzySearchHighlights result. Positions holds
+// the rune indexes of Key that matched the query, in ascending order.
+type HighlightedMatch struct {
+	Key       string
+	Positions []int
+}
+
+// FuzzySearchHighlights performs the same search as FuzzySearch but
+// also reports which runes of each result matched the query, for
+// example to render them in bold. Results are ordered as FuzzySearch
+// orders them.
+func (t *Trie[T]) FuzzySearchHighlights(pre string) []HighlightedMatch {
+	defer t.runlock(t.rlock())
+
+	var matches []HighlightedMatch
+	fuzzywalk(t.root, t.foldrunes([]rune(pre)), t.fold, true, func(n *node[T], positions []int) bool {
+		for _, key := range collect(n) {
+			matches = append(matches, HighlightedMatch{
+				Key:       key,
+				Positions: append([]int(nil), positions...),
+			})
+		}
+		return true
+	})
+	if t.collator != nil {
+		t.collMu.Lock()
+		defer t.collMu.Unlock()
+	}
+	sort.Slice(matches, func(i, j int) bool { return t.lessByLength(matches[i].Key, matches[j].Key) })
+	return matches
+}
+
+// RecomputeMasks rebuilds every node's bitmask from its own rune and
+// its children, repairing masks left inconsistent by older versions of
+// Remove without rebuilding the trie.
+func (t *Trie[T]) RecomputeMasks() {
+	t.lock()
+	defer t.unlock()
+
+	t.postorder(true, func(n *node[T]) {
+		n.mask = t.maskruneslice([]rune{n.val})
+		n.eachChild(func(c *node[T]) bool {
+			n.mask |= c.mask
+			return true
+		})
+	})
+}
+
+// EnableWAL makes the trie append a record of every key it adds or
+// removes to w, so that its keys can later be rebuilt with ReplayWAL.
+// Meta data is stored as returned by encodeMeta. Records are written
+// with the write lock held. Meta updated in place through Each is not
+// logged. Passing a nil writer disables logging.
+func (t *Trie[T]) EnableWAL(w io.Writer, encodeMeta func(T) []byte) {
+	t.lock()
+	defer t.unlock()
+
+	t.wal = w
+	t.walErr = nil
+	t.encodeMeta = encodeMeta
+}
+
+// WALErr returns the first error encountered writing to the log set by
+// EnableWAL. Logging stops after an error.
+func (t *Trie[T]) WALErr() error {
+	defer t.runlock(t.rlock())
+
+	return t.walErr
+}
+
+// ReplayWAL applies every record of a log written after EnableWAL to
+// the trie, decoding meta data with decodeMeta.
+func (t *Trie[T]) ReplayWAL(r io.Reader, decodeMeta func([]byte) T) error {
+	br := bufio.NewReader(r)
+	for {
+		op, err := br.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		key, err := readChunk(br)
+		if err != nil {
+			return err
+		}
+
+		switch op {
+		case walAdd:
+			raw, err := readChunk(br)
+			if err != nil {
+				return err
+			}
+			if t.Add(string(key), decodeMeta(raw)) == nil {
+				return ErrNodeLimit
+			}
+		case walRemove:
+			t.Remove(string(key))
+		default:
+			return errBadWALRecord
+		}
+	}
+}
+
+// NearestK returns up to k keys with the smallest Levenshtein distance
+// to query, closest first. Keys at equal distance are ordered
+// lexically.
+func (t *Trie[T]) NearestK(query string, k int) []string {
+	defer t.runlock(t.rlock())
+
+	if k <= 0 {
+		return nil
+	}
+
+	type candidate struct {
+		key  string
+		dist int
+	}
+	var (
+		q    = []rune(query)
+		best = make([]candidate, 0, k)
+	)
+	less := func(a, b candidate) bool {
+		return a.dist < b.dist || (a.dist == b.dist && a.key < b.key)
+	}
+
+	editwalk(t.root, q, func(n *node[T], row []int) int {
+		if n.term {
+			c := candidate{key: n.path, dist: row[len(q)]}
+			if len(best) < k || less(c, best[len(best)-1]) {
+				i := sort.Search(len(best), func(i int) bool { return less(c, best[i]) })
+				if len(best) < k {
+					best = append(best, candidate{})
+				}
+				copy(best[i+1:], best[i:])
+				best[i] = c
+			}
+		}
+		if len(best) < k {
+			return math.MaxInt
+		}
+		return best[len(best)-1].dist
+	})
+
+	keys := make([]string, len(best))
+	for i, c := range best {
+		keys[i] = c.key
+	}
+	return keys
+}
+
+// BranchingReport returns a histogram mapping a number of children to
+// how many nodes have that many. The terminal markers are nodes too, so
+// they show up under zero, and a node ending a key counts its marker
+// as a child. Long runs of single-child nodes suggest keys that would
+// benefit from prefix compression.
+func (t *Trie[T]) BranchingReport() map[int]int {
+	defer t.runlock(t.rlock())
+
+	report := make(map[int]int)
+	nodes := []*node[T]{t.root}
+	for len(nodes) > 0 {
+		i := len(nodes) - 1
+		n := nodes[i]
+		nodes = nodes[:i]
+		report[n.numChildren()]++
+		nodes = n.appendChildren(nodes)
+	}
+	return report
+}
+
+// DepthHistogram returns a histogram mapping a depth to how many nodes
+// sit at it, gathered in one breadth-first pass. The root is alone at
+// depth zero, and as in BranchingReport terminal markers are nodes too,
+// one level below the last rune of their key. Few nodes per level
+// relative to the number of keys suggests long shared chains that
+// prefix compression would collapse.
+func (t *Trie[T]) DepthHistogram() map[int]int {
+	defer t.runlock(t.rlock())
+
+	hist := make(map[int]int)
+	queue := []*node[T]{t.root}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		hist[n.depth]++
+		queue = n.appendChildren(queue)
+	}
+	return hist
+}
+
+// PrefixSearchMaxDepth is like PrefixSearch but only returns keys that
+// extend `pre` by at most maxDepth runes; the traversal does not descend
+// any deeper. Longer keys are left out rather than truncated, so every
+// result is a stored key. A maxDepth of zero returns at most `pre`
+// itself.
+func (t *Trie[T]) PrefixSearchMaxDepth(pre string, maxDepth int) []string {
+	defer t.runlock(t.rlock())
+
+	nd := findNode(t.root, []rune(pre))
+	if nd == nil || maxDepth < 0 {
+		return nil
+	}
+
+	var (
+		keys  []string
+		limit = nd.depth + maxDepth
+		nodes = []*node[T]{nd}
+	)
+	for len(nodes) > 0 {
+		i := len(nodes) - 1
+		n := nodes[i]
+		nodes = nodes[:i]
+		if n.term {
+			keys = append(keys, n.path)
+			continue
+		}
+		n.eachChild(func(c *node[T]) bool {
+			if c.val == nul || c.depth <= limit {
+				nodes = append(nodes, c)
+			}
+			return true
+		})
+	}
+	return keys
+}
+
+// CountingTrie is a Trie whose meta data is the number of times each
+// key has been added, for use as a frequency dictionary. All of the
+// Trie search methods are available on it.
+type CountingTrie struct {
+	*Trie[int]
+}
+
+// NewCounting creates an empty CountingTrie.
+func NewCounting(opts ...Option[int]) *CountingTrie {
+	return &CountingTrie{New(opts...)}
+}
+
+// Add increments the count of key, adding it if needed, and returns
+// the new count. It returns 0 if key is new and WithMaxNodes leaves no
+// room for it.
+func (c *CountingTrie) Add(key string) int {
+	c.lock()
+	defer c.unlock()
+
+	count := 1
+	if n, ok := c.find(key); ok {
+		count += n.meta
+	}
+	if c.add(key, count) == nil {
+		return 0
+	}
+	return count
+}
+
+// Count returns how many times key has been added, less the times it
+// has been removed.
+func (c *CountingTrie) Count(key string) int {
+	defer c.runlock(c.rlock())
+
+	if n, ok := c.find(key); ok {
+		return n.meta
+	}
+	return 0
+}
+
+// Remove decrements the count of key, removing the key once the count
+// reaches zero, and returns the remaining count.
+func (c *CountingTrie) Remove(key string) int {
+	c.lock()
+	defer c.unlock()
+
+	n, ok := c.find(key)
+	if !ok {
+		return 0
+	}
+	if n.meta <= 1 {
+		c.removeTerminal(n)
+		return 0
+	}
+	return c.add(key, n.meta-1).meta
+}
+
+// IsSubsetOf reports whether every key of t is also stored in other.
+// The two tries are never locked at the same time, so the result is
+// only consistent if neither is modified concurrently.
+func (t *Trie[T]) IsSubsetOf(other *Trie[T]) bool {
+	if t == other {
+		return true
+	}
+
+	keys := t.Keys()
+
+	defer other.runlock(other.rlock())
+
+	for _, key := range keys {
+		if _, ok := other.find(key); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// PatternSearch returns the keys that match pat rune for rune. In pat,
+// '?' matches any single rune and a class such as "[abc]" or "[a-c]"
+// matches any single rune it lists; "[^...]" negates a class. A
+// backslash makes the rune after it literal. Unterminated classes are
+// taken literally.
+func (t *Trie[T]) PatternSearch(pat string) []string {
+	defer t.runlock(t.rlock())
+
+	matchers := parsePattern([]rune(pat))
+
+	type frame struct {
+		node *node[T]
+		idx  int
+	}
+
+	var keys []string
+	stack := []frame{{t.root, 0}}
+	for len(stack) > 0 {
+		i := len(stack) - 1
+		f := stack[i]
+		stack = stack[:i]
+		if f.idx == len(matchers) {
+			if n, ok := f.node.Child(nul); ok && n.term {
+				keys = append(keys, n.path)
+			}
+			continue
+		}
+		f.node.eachChild(func(c *node[T]) bool {
+			if c.val != nul && matchers[f.idx](c.val) {
+				stack = append(stack, frame{c, f.idx + 1})
+			}
+			return true
+		})
+	}
+	return keys
+}
+
+// Validate checks the trie's internal bookkeeping as CheckInvariants
+// does, returning the first problem found as an error. It is intended
+// as a debugging and testing aid.
+func (t *Trie[T]) Validate() error {
+	defer t.runlock(t.rlock())
+
+	if problems := t.checkInvariants(); len(problems) > 0 {
+		return errors.New("trie: " + problems[0])
+	}
+	return nil
+}
+
+// CheckInvariants describes every inconsistency in the trie's internal
+// bookkeeping: a node whose bitmask is not the union of its own rune
+// and its children, a termCount that disagrees with the keys beneath
+// its node, a child whose parent pointer leads elsewhere, and a size or
+// node count that disagrees with what is stored. A consistent trie
+// yields no problems.
+func (t *Trie[T]) CheckInvariants() []string {
+	defer t.runlock(t.rlock())
+
+	return t.checkInvariants()
+}
+
+func (t *Trie[T]) checkInvariants() []string {
+	var problems []string
+	report := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	keys := make(map[*node[T]]int, t.nodes+1)
+	nodes := 0
+	t.postorder(false, func(n *node[T]) {
+		nodes++
+		mask := t.maskruneslice([]rune{n.val})
+		if n.term {
+			keys[n] = 1
+		}
+		for r, c := range n.children {
+			if r != c.val {
+				report("node at depth %d (%q) keeps a child under the wrong rune", n.depth, n.val)
+			}
+			if c.parent != n {
+				report("node at depth %d (%q) does not point back to its parent", c.depth, c.val)
+			}
+			mask |= c.mask
+			keys[n] += keys[c]
+		}
+		if n.mask != mask {
+			report("node at depth %d (%q) has mask %b, expected %b", n.depth, n.val, n.mask, mask)
+		}
+		if (n == t.root || n.val != nul) && n.termCount != keys[n] {
+			report("node at depth %d (%q) has termCount %d, but %d keys are beneath it", n.depth, n.val, n.termCount, keys[n])
+		}
+	})
+
+	if keys[t.root] != t.size {
+		report("size is %d but %d keys are stored", t.size, keys[t.root])
+	}
+	if nodes-1 != t.nodes {
+		report("node count is %d but %d nodes are stored", t.nodes, nodes-1)
+	}
+	return problems
+}
+
+// Path returns the key the node stores. Intermediate nodes only know
+// their prefix when the trie was created WithNodePaths; otherwise they
+// return the empty string.
+func (n *node[T]) Path() string {
+	return n.path
+}
+
+// Meta returns a copy of the meta data stored with the node.
+func (n *node[T]) Meta() T {
+	return n.meta
+}
+
+// MetaPtr returns a pointer to the meta data stored with the node, so
+// large values can be read or updated in place without copying. The
+// pointer bypasses the trie's lock: callers must ensure nothing else
+// writes the same key, e.g. through Add or Each, while it is in use.
+// Writes through it are kept even under WithKeysOnly, but not once a
+// trie created WithLockFreeReads has copied the node.
+func (n *node[T]) MetaPtr() *T {
+	return &n.meta
+}
+
+// SuffixesOfPrefix is like PrefixSearch but returns each completion
+// with `pre` trimmed off, e.g. "bar/baz.go" rather than "foo/bar/baz.go"
+// for the prefix "foo/". A key equal to `pre` yields the empty string.
+func (t *Trie[T]) SuffixesOfPrefix(pre string) []string {
+	defer t.runlock(t.rlock())
+
+	keys := t.prefixSearch(pre)
+	for i, key := range keys {
+		// Every completion starts with the bytes of pre, so slicing
+		// never splits a multibyte rune.
+		keys[i] = key[len(pre):]
+	}
+	return keys
+}
+
+// FuzzyPrefixSearch is a PrefixSearch that tolerates typos in the
+// prefix: it returns the completions of every node whose path is within
+// maxDist Levenshtein edits of `pre`.
+func (t *Trie[T]) FuzzyPrefixSearch(pre string, maxDist int) []string {
+	defer t.runlock(t.rlock())
+
+	var (
+		keys []string
+		q    = []rune(pre)
+	)
+	editwalk(t.root, q, func(n *node[T], row []int) int {
+		if !n.term && row[len(q)] <= maxDist {
+			keys = append(keys, collect(n)...)
+			// The whole subtree has been collected; prune it.
+			return -1
+		}
+		return maxDist
+	})
+	return keys
+}
+
+// Alphabet returns the distinct runes used by the stored keys, in
+// ascending order.
+func (t *Trie[T]) Alphabet() []rune {
+	defer t.runlock(t.rlock())
+
+	seen := make(map[rune]struct{})
+	nodes := []*node[T]{t.root}
+	for len(nodes) > 0 {
+		i := len(nodes) - 1
+		n := nodes[i]
+		nodes = nodes[:i]
+		n.eachChild(func(c *node[T]) bool {
+			if c.val != nul {
+				seen[c.val] = struct{}{}
+			}
+			nodes = append(nodes, c)
+			return true
+		})
+	}
+
+	alphabet := make([]rune, 0, len(seen))
+	for r := range seen {
+		alphabet = append(alphabet, r)
+	}
+	slices.Sort(alphabet)
+	return alphabet
+}
+
+// Next returns the smallest stored key that sorts lexically after
+// `key`, which need not be stored itself. ok is false when no key
+// follows it.
+func (t *Trie[T]) Next(key string) (string, bool) {
+	defer t.runlock(t.rlock())
+
+	var (
+		runes = []rune(key)
+		nd    = t.root
+		next  *node[T]
+	)
+	for _, c := range runes {
+		// The deeper the branch, the closer its keys are to key.
+		if n := nd.childAfter(c); n != nil {
+			next = n
+		}
+		n, ok := nd.Child(c)
+		if !ok {
+			break
+		}
+		nd = n
+	}
+	if nd.depth == len(runes) {
+		if n := nd.childAfter(nul); n != nil {
+			next = n
+		}
+	}
+
+	if next == nil {
+		return "", false
+	}
+	return next.minKey(), true
+}
+
+// Prev returns the largest stored key that sorts lexically before
+// `key`, which need not be stored itself. ok is false when no key
+// precedes it.
+func (t *Trie[T]) Prev(key string) (string, bool) {
+	defer t.runlock(t.rlock())
+
+	var (
+		nd   = t.root
+		prev string
+		ok   bool
+	)
+	for _, c := range []rune(key) {
+		// A sibling branch sorts after its parent's own key, and deeper
+		// candidates are always closer to key.
+		if n := nd.childBefore(c); n != nil {
+			prev, ok = n.maxKey(), true
+		} else if n, found := nd.Child(nul); found && n.term {
+			prev, ok = n.path, true
+		}
+		n, found := nd.Child(c)
+		if !found {
+			break
+		}
+		nd = n
+	}
+	return prev, ok
+}
+
+// Child returns the child of n for rune r and whether it exists. It is
+// safe on a node whose children map was never allocated.
+func (n *node[T]) Child(r rune) (*node[T], bool) {
+	c, ok := n.children[r]
+	return c, ok
+}
+
+// numChildren returns the number of children of n.
+func (n *node[T]) numChildren() int {
+	return len(n.children)
+}
+
+// setChild makes c the child of n for c's rune, replacing any child
+// already there.
+func (n *node[T]) setChild(c *node[T]) {
+	if n.children == nil {
+		n.children = make(map[rune]*node[T])
+	}
+	n.children[c.val] = c
+}
+
+// deleteChild removes the child of n for rune r, if there is one.
+func (n *node[T]) deleteChild(r rune) {
+	delete(n.children, r)
+}
+
+// appendChildren appends the children of n to dst, in no particular
+// order, and returns the extended slice.
+func (n *node[T]) appendChildren(dst []*node[T]) []*node[T] {
+	for _, c := range n.children {
+		dst = append(dst, c)
+	}
+	return dst
+}
+
+// eachChild calls fn with every child of n, in no particular order,
+// stopping early when fn returns false. It reports whether every child
+// was visited.
+func (n *node[T]) eachChild(fn func(*node[T]) bool) bool {
+	for _, c := range n.children {
+		if !fn(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// SortedChildren returns the children of n ordered by rune. When n ends
+// a key, its terminal marker, whose rune is zero, comes first.
+func (n *node[T]) SortedChildren() []*node[T] {
+	children := n.appendChildren(make([]*node[T], 0, n.numChildren()))
+	sort.Slice(children, func(i, j int) bool { return children[i].val < children[j].val })
+	return children
+}
+
+// childAfter returns the child with the smallest rune greater than r.
+// Like childBefore, it skips subtrees holding only soft-deleted keys.
+func (n *node[T]) childAfter(r rune) *node[T] {
+	var next *node[T]
+	n.eachChild(func(c *node[T]) bool {
+		if c.val > r && c.termCount > 0 && (next == nil || c.val < next.val) {
+			next = c
+		}
+		return true
+	})
+	return next
+}
+
+// childBefore returns the child with the largest rune less than r,
+// ignoring the terminal marker.
+func (n *node[T]) childBefore(r rune) *node[T] {
+	var prev *node[T]
+	n.eachChild(func(c *node[T]) bool {
+		if c.val != nul && c.val < r && c.termCount > 0 && (prev == nil || c.val > prev.val) {
+			prev = c
+		}
+		return true
+	})
+	return prev
+}
+
+// minKey returns the lexically smallest key in the node's subtree.
+func (n *node[T]) minKey() string {
+	for !n.term {
+		if c, ok := n.Child(nul); ok && c.term {
+			return c.path
+		}
+		n = n.childAfter(nul)
+	}
+	return n.path
+}
+
+// maxKey returns the lexically largest key in the node's subtree.
+func (n *node[T]) maxKey() string {
+	for !n.term {
+		if c := n.childBefore(utf8.MaxRune + 1); c != nil {
+			n = c
+			continue
+		}
+		n, _ = n.Child(nul)
+	}
+	return n.path
+}
+
+// FuzzyWalk calls fn for every key FuzzySearch would return, in no
+// particular order, stopping as soon as fn returns false. Unlike
+// FuzzySearch it neither builds nor sorts a result slice. The read lock
+// is held while fn runs, so fn must not modify the trie.
+func (t *Trie[T]) FuzzyWalk(pre string, fn func(key string, meta T) bool) {
+	defer t.runlock(t.rlock())
+
+	fuzzywalk(t.root, t.foldrunes([]rune(pre)), t.fold, false, func(n *node[T], _ []int) bool {
+		return eachTerminal(n, func(term *node[T]) bool {
+			return fn(term.path, term.meta)
+		})
+	})
+}
+
+// FuzzyCount returns the number of keys FuzzySearch would return
+// without collecting them. Every key beneath a matching node matches,
+// so the node's termCount is added rather than walking its subtree.
+func (t *Trie[T]) FuzzyCount(pre string) int {
+	defer t.runlock(t.rlock())
+
+	count := 0
+	fuzzywalk(t.root, t.foldrunes([]rune(pre)), t.fold, false, func(n *node[T], _ []int) bool {
+		count += n.termCount
+		return true
+	})
+	return count
+}
+
+// Entry is a key stored in the trie along with its meta data and, for
+// scored searches, how well it matched.
+type Entry[T any] struct {
+	Key   string
+	Meta  T
+	Score float64
+}
+
+// FuzzySearchWeighted returns the keys FuzzySearch would, best first by
+//
+//	Score = (1-blend)*quality + blend*weight(meta)
+//
+// where quality is the fraction of the key's runes matched by `pre` and
+// blend is set with WithWeightBlend. weight should return values in
+// [0, 1] to be on the same scale as quality. Equal scores are ordered
+// as FuzzySearch orders keys.
+func (t *Trie[T]) FuzzySearchWeighted(pre string, weight func(T) float64) []Entry[T] {
+	defer t.runlock(t.rlock())
+
+	q := t.foldrunes([]rune(pre))
+	var entries []Entry[T]
+	fuzzywalk(t.root, q, t.fold, false, func(n *node[T], _ []int) bool {
+		eachTerminal(n, func(n *node[T]) bool {
+			quality := 1.0
+			if l := n.depth - 1; l > 0 {
+				quality = float64(len(q)) / float64(l)
+			}
+			entries = append(entries, Entry[T]{
+				Key:   n.path,
+				Meta:  n.meta,
+				Score: (1-t.weightBlend)*quality + t.weightBlend*weight(n.meta),
+			})
+			return true
+		})
+		return true
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Score != entries[j].Score {
+			return entries[i].Score > entries[j].Score
+		}
+		return ByKeys{entries[i].Key, entries[j].Key}.Less(0, 1)
+	})
+	return entries
+}
+
+// EditSearch returns the keys within maxDist Levenshtein edits of
+// query, closest first and lexically among equals.
+func (t *Trie[T]) EditSearch(query string, maxDist int) []string {
+	defer t.runlock(t.rlock())
+
+	return t.editSearch([]rune(query), maxDist)
+}
+
+// EditSearchRelative is EditSearch with the distance scaled to the
+// query: up to ceil(ratio * runes in query) edits are allowed, and
+// never fewer than one.
+func (t *Trie[T]) EditSearchRelative(query string, ratio float64) []string {
+	defer t.runlock(t.rlock())
+
+	q := []rune(query)
+	maxDist := max(int(math.Ceil(ratio*float64(len(q)))), 1)
+	return t.editSearch(q, maxDist)
+}
+
+// HammingSearch returns the keys of the same length in runes as query
+// that differ from it in at most maxDist positions, closest first and
+// lexically among equals. Subtrees are pruned as soon as their
+// mismatches exceed maxDist, so small bounds visit little of the trie.
+func (t *Trie[T]) HammingSearch(query string, maxDist int) []string {
+	defer t.runlock(t.rlock())
+
+	type frame struct {
+		node *node[T]
+		dist int
+	}
+
+	q := []rune(query)
+	var matches []distMatch
+	stack := []frame{{t.root, 0}}
+	for len(stack) > 0 {
+		i := len(stack) - 1
+		f := stack[i]
+		stack = stack[:i]
+
+		if f.node.depth == len(q) {
+			if term, ok := f.node.Child(nul); ok && term.term {
+				matches = append(matches, distMatch{term.path, f.dist})
+			}
+			continue
+		}
+		next := q[f.node.depth]
+		f.node.eachChild(func(c *node[T]) bool {
+			if c.val == nul {
+				return true
+			}
+			dist := f.dist
+			if c.val != next {
+				dist++
+			}
+			if dist <= maxDist {
+				stack = append(stack, frame{c, dist})
+			}
+			return true
+		})
+	}
+	return rankByDistance(matches)
+}
+
+// PrefixCount pairs a prefix with the number of keys that start with it.
+type PrefixCount struct {
+	Prefix string
+	Count  int
+}
+
+// HottestPrefixes returns up to k prefixes of exactly depth runes that
+// have the most completions, most popular first and lexically among
+// equals.
+func (t *Trie[T]) HottestPrefixes(depth, k int) []PrefixCount {
+	defer t.runlock(t.rlock())
+
+	counts := prefixCounts(t.root, nil, depth)
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Prefix < counts[j].Prefix
+	})
+	if k < len(counts) {
+		counts = counts[:max(k, 0)]
+	}
+	return counts
+}
+
+// Facet is a PrefixFacets result: an extension of the searched prefix
+// and how many keys start with it.
+type Facet = PrefixCount
+
+// PrefixFacets returns every extension of `pre` by exactly depth runes
+// that some stored key starts with, along with how many keys do, in
+// lexical order. A depth of 1 yields one facet per next rune.
+func (t *Trie[T]) PrefixFacets(pre string, depth int) []Facet {
+	defer t.runlock(t.rlock())
+
+	runes := []rune(pre)
+	nd := findNode(t.root, runes)
+	if nd == nil || depth < 0 {
+		return nil
+	}
+
+	facets := prefixCounts(nd, runes, depth)
+	sort.Slice(facets, func(i, j int) bool {
+		return facets[i].Prefix < facets[j].Prefix
+	})
+	return facets
+}
+
+// Diff compares the keys of t, taken as the old version, with those of
+// other, the new version. added holds the keys only other has, removed
+// those only t has, both sorted. Like IsSubsetOf, the tries are not
+// locked together.
+func (t *Trie[T]) Diff(other *Trie[T]) (added, removed []string) {
+	old, cur := t.Keys(), other.Keys()
+	sort.Strings(old)
+	sort.Strings(cur)
+
+	added, removed = []string{}, []string{}
+	i, j := 0, 0
+	for i < len(old) || j < len(cur) {
+		switch {
+		case j == len(cur) || (i < len(old) && old[i] < cur[j]):
+			removed = append(removed, old[i])
+			i++
+		case i == len(old) || cur[j] < old[i]:
+			added = append(added, cur[j])
+			j++
+		default:
+			i++
+			j++
+		}
+	}
+	return added, removed
+}
+
+// PrefixSearchJoined returns the completions of `pre` joined by sep,
+// writing them straight into the result rather than building a slice
+// first. The order is that of PrefixSearch.
+func (t *Trie[T]) PrefixSearchJoined(pre, sep string) string {
+	defer t.runlock(t.rlock())
+
+	if t.collator != nil {
+		// Collated order needs every key up front.
+		return strings.Join(t.prefixSearch(pre), sep)
+	}
+
+	nd := findNode(t.root, []rune(pre))
+	if nd == nil {
+		return ""
+	}
+
+	var b strings.Builder
+	eachTerminal(nd, func(n *node[T]) bool {
+		if b.Len() > 0 {
+			b.WriteString(sep)
+		}
+		b.WriteString(n.path)
+		return true
+	})
+	return b.String()
+}
+
+// KeysInRange returns the keys whose first rune lies within [lo, hi],
+// visiting only the matching children of the root. This makes it easy
+// to shard work by leading letter.
+func (t *Trie[T]) KeysInRange(lo, hi rune) []string {
+	defer t.runlock(t.rlock())
+
+	var keys []string
+	t.root.eachChild(func(c *node[T]) bool {
+		if c.val != nul && c.val >= lo && c.val <= hi {
+			keys = append(keys, collect(c)...)
+		}
+		return true
+	})
+	return keys
+}
+
+// AddTag attaches tag to key, for later retrieval with KeysWithTag. It
+// reports whether key is stored. Tags go away with their key.
+func (t *Trie[T]) AddTag(key, tag string) bool {
+	t.lock()
+	defer t.unlock()
+
+	n, ok := t.find(key)
+	if !ok {
+		return false
+	}
+	if t.tags == nil {
+		t.tags = make(map[string]map[*node[T]]struct{})
+	}
+	if t.tags[tag] == nil {
+		t.tags[tag] = make(map[*node[T]]struct{})
+	}
+	t.tags[tag][n] = struct{}{}
+	return true
+}
+
+// KeysWithTag returns the keys tagged with tag, in no particular order.
+func (t *Trie[T]) KeysWithTag(tag string) []string {
+	defer t.runlock(t.rlock())
+
+	keys := make([]string, 0, len(t.tags[tag]))
+	for n := range t.tags[tag] {
+		if n.term {
+			keys = append(keys, n.path)
+		}
+	}
+	return keys
+}
+
+// LongestKey returns the stored key with the most runes, choosing the
+// lexically smallest among equally long keys. ok is false if the trie
+// is empty.
+func (t *Trie[T]) LongestKey() (string, bool) {
+	defer t.runlock(t.rlock())
+
+	var longest *node[T]
+	eachTerminal(t.root, func(n *node[T]) bool {
+		if longest == nil || n.depth > longest.depth ||
+			(n.depth == longest.depth && n.path < longest.path) {
+			longest = n
+		}
+		return true
+	})
+	if longest == nil {
+		return "", false
+	}
+	return longest.path, true
+}
+
+// AppendKeys appends every key to dst and returns the extended slice,
+// in the manner of strconv.AppendInt, so callers can reuse a buffer.
+func (t *Trie[T]) AppendKeys(dst []string) []string {
+	defer t.runlock(t.rlock())
+
+	start := len(dst)
+	dst = slices.Grow(dst, t.size)
+	eachTerminal(t.root, func(n *node[T]) bool {
+		dst = append(dst, n.path)
+		return true
+	})
+	t.collate(dst[start:])
+	return dst
+}
+
+// FuzzySearchAtLeast is a forgiving FuzzySearch. It starts with the
+// keys FuzzySearch returns and, while it has fewer than min results,
+// also accepts keys that contain `pre` as a subsequence after one and
+// then two edits (a rune of `pre` substituted or dropped). Results are
+// ordered by the number of edits needed, then as FuzzySearch orders
+// them. Fewer than atLeast keys are returned if no more are that close.
+// Subtrees missing more than two of the runes of `pre` are skipped, but
+// a short `pre` still has the walk visit most of the trie.
+func (t *Trie[T]) FuzzySearchAtLeast(pre string, atLeast int) []string {
+	defer t.runlock(t.rlock())
+
+	const maxRelax = 2
+
+	var (
+		q      = t.foldrunes([]rune(pre))
+		levels [maxRelax + 1][]string
+	)
+	subseqwalk(t.root, q, t.fold, maxRelax, func(n *node[T], dist int) {
+		levels[dist] = append(levels[dist], n.path)
+	})
+
+	keys := []string{}
+	for i, level := range levels {
+		if i > 0 && len(keys) >= atLeast {
+			break
+		}
+		t.sortByLength(level)
+		keys = append(keys, level...)
+	}
+	return keys
+}
+
+// ErrFrozen is the value Add, Remove and other modifying methods panic
+// with once the trie has been frozen.
+var ErrFrozen = errors.New("trie: modifying a frozen trie")
+
+// Freeze makes the trie read-only. It compacts every node, releasing
+// capacity left over from removals, and from then on reads no longer
+// take the lock while any method that would modify the trie panics
+// with ErrFrozen. A frozen trie cannot be thawed; freezing it again
+// does nothing.
+func (t *Trie[T]) Freeze() {
+	t.mu.Lock()
+	defer t.unlock()
+	if t.frozen.Load() {
+		return
+	}
+
+	t.shrink()
+	t.frozen.Store(true)
+}
+
+// ShrinkToFit releases the capacity nodes keep after keys beneath them
+// are removed by rebuilding every children map at its current size.
+// Keys themselves have no children, so their maps are dropped
+// altogether; ShrinkToFit reports how many were.
+func (t *Trie[T]) ShrinkToFit() int {
+	t.lock()
+	defer t.unlock()
+
+	return t.shrink()
+}
+
+// Frozen reports whether Freeze has been called.
+func (t *Trie[T]) Frozen() bool {
+	return t.frozen.Load()
+}
+
+// MergedSortedCompletions returns the completions of every prefix in
+// prefixes, merged into a single lexically sorted list without
+// duplicates. Each prefix's subtree is enumerated in order and the
+// results are combined with a k-way merge rather than a full sort.
+func (t *Trie[T]) MergedSortedCompletions(prefixes []string) []string {
+	defer t.runlock(t.rlock())
+
+	var lists [][]string
+	total := 0
+	for _, pre := range prefixes {
+		nd := findNode(t.root, []rune(pre))
+		if nd == nil {
+			continue
+		}
+		keys := collectOrdered(nd, false)
+		lists = append(lists, keys)
+		total += len(keys)
+	}
+
+	merged := make([]string, 0, total)
+	for {
+		best := -1
+		for i, l := range lists {
+			if len(l) > 0 && (best < 0 || l[0] < lists[best][0]) {
+				best = i
+			}
+		}
+		if best < 0 {
+			return merged
+		}
+		key := lists[best][0]
+		lists[best] = lists[best][1:]
+		if len(merged) == 0 || merged[len(merged)-1] != key {
+			merged = append(merged, key)
+		}
+	}
+}
+
+// PrefixSearchMulti returns the completions of each prefix, as
+// PrefixSearch would, keyed by prefix. The whole batch is served under
+// a single read lock, so every group reflects the same state of the
+// trie.
+func (t *Trie[T]) PrefixSearchMulti(prefixes []string) map[string][]string {
+	defer t.runlock(t.rlock())
+
+	groups := make(map[string][]string, len(prefixes))
+	for _, pre := range prefixes {
+		groups[pre] = t.prefixSearch(pre)
+	}
+	return groups
+}
+
+// ToMap returns every key mapped to its meta data, gathered in a single
+// traversal. Meta data is copied by value, so pointer or reference
+// types still share what they point to. The map holds an entry per key,
+// which for very large tries is a large allocation.
+func (t *Trie[T]) ToMap() map[string]T {
+	defer t.runlock(t.rlock())
+
+	m := make(map[string]T, t.size)
+	eachTerminal(t.root, func(n *node[T]) bool {
+		m[n.path] = n.meta
+		return true
+	})
+	return m
+}
+
+// SoftDelete marks key as deleted without removing it, reporting
+// whether it was stored. A soft-deleted key is skipped by Find, Keys
+// and every search, and no longer counts towards the trie's size, but
+// keeps its node and meta data until Resurrect restores it or
+// PurgeTombstones removes it. Adding the key again also restores it.
+func (t *Trie[T]) SoftDelete(key string) bool {
+	t.lock()
+	defer t.unlock()
+
+	n, ok := t.find(key)
+	if !ok {
+		return false
+	}
+	t.logWAL(walRemove, n.path, n.meta)
+	n = t.own(n)
+	n.term, n.deleted = false, true
+	t.size--
+	for p := n.parent; p != nil; p = p.parent {
+		p.termCount--
+	}
+	return true
+}
+
+// Resurrect restores a key removed by SoftDelete along with its meta
+// data, reporting whether key was soft-deleted.
+func (t *Trie[T]) Resurrect(key string) bool {
+	t.lock()
+	defer t.unlock()
+
+	nd := findNode(t.root, []rune(key))
+	if nd == nil {
+		return false
+	}
+	n, ok := nd.Child(nul)
+	if !ok || !n.deleted {
+		return false
+	}
+	t.revive(t.own(n))
+	return true
+}
+
+// PurgeTombstones removes every soft-deleted key from the trie, along
+// with the nodes that only led to them, and reports how many there
+// were.
+func (t *Trie[T]) PurgeTombstones() int {
+	t.lock()
+	defer t.unlock()
+
+	var dead []*node[T]
+	nodes := []*node[T]{t.root}
 	for len(nodes) > 0 {
 		i := len(nodes) - 1
 		n := nodes[i]
 		nodes = nodes[:i]
-		for _, c := range n.children {
-			nodes = append(nodes, c)
+		if n.deleted {
+			dead = append(dead, n)
+		}
+		nodes = n.appendChildren(nodes)
+	}
+
+	for _, n := range dead {
+		t.untag(n)
+		t.detach(n)
+	}
+	return len(dead)
+}
+
+// PrefixSearchExcluding returns the completions of `pre` that are not
+// in exclude, in the order of PrefixSearch. Excluded keys are skipped
+// during the traversal rather than filtered out afterwards, which suits
+// paging through results the caller has already shown.
+func (t *Trie[T]) PrefixSearchExcluding(pre string, exclude map[string]struct{}) []string {
+	defer t.runlock(t.rlock())
+
+	nd := findNode(t.root, []rune(pre))
+	if nd == nil {
+		return nil
+	}
+
+	keys := make([]string, 0, max(nd.termCount-len(exclude), 0))
+	eachTerminal(nd, func(n *node[T]) bool {
+		if _, ok := exclude[n.path]; !ok {
+			keys = append(keys, n.path)
+		}
+		return true
+	})
+	t.collate(keys)
+	return keys
+}
+
+// Reader is a read-only view of a trie that holds its read lock from
+// Reader until Close, so that many lookups can be issued without
+// locking for each. Writes block until every Reader is closed. A Reader
+// may be shared by goroutines, but while it is open its holder must not
+// call methods on the trie itself: a waiting writer would then deadlock
+// the nested read lock.
+type Reader[T any] struct {
+	t      *Trie[T]
+	locked bool
+}
+
+// Reader takes the trie's read lock and returns a Reader holding it.
+// Close must be called to release it.
+func (t *Trie[T]) Reader() *Reader[T] {
+	return &Reader[T]{t: t, locked: t.rlock()}
+}
+
+// Close releases the read lock. It is safe to call more than once, but
+// the Reader must not be used afterwards.
+func (r *Reader[T]) Close() {
+	if r.t == nil {
+		return
+	}
+	r.t.runlock(r.locked)
+	r.t = nil
+}
+
+// Find is Trie.Find without taking the lock. It bypasses the miss
+// cache, which is only kept up to date by Trie.Find.
+func (r *Reader[T]) Find(key string) (*node[T], bool) {
+	return r.t.find(key)
+}
+
+// PrefixSearch is Trie.PrefixSearch without taking the lock.
+func (r *Reader[T]) PrefixSearch(pre string) []string {
+	return r.t.prefixSearch(pre)
+}
+
+// FuzzySearch is Trie.FuzzySearch without taking the lock.
+func (r *Reader[T]) FuzzySearch(pre string) []string {
+	return r.t.fuzzySearch(pre)
+}
+
+// LongestCommonPrefix returns the longest prefix shared by every stored
+// key. It is empty when the keys diverge at their first rune, when one
+// of them is the empty string, or when the trie is empty.
+func (t *Trie[T]) LongestCommonPrefix() string {
+	defer t.runlock(t.rlock())
+
+	if t.size == 0 {
+		return ""
+	}
+
+	var prefix []rune
+	nd := t.root
+	for {
+		// Subtrees left holding only soft-deleted keys do not count.
+		var next *node[T]
+		live := 0
+		nd.eachChild(func(c *node[T]) bool {
+			if c.term || c.termCount > 0 {
+				next = c
+				live++
+			}
+			return live < 2
+		})
+		if live != 1 || next.val == nul {
+			return string(prefix)
+		}
+		prefix = append(prefix, next.val)
+		nd = next
+	}
+}
+
+// Query runs a search written in a small syntax suited to search boxes:
+//
+//	foo*   keys starting with foo, as PrefixSearch("foo")
+//	~foo   keys containing foo as a subsequence, as FuzzySearch("foo")
+//	foo    foo itself, if it is stored
+//
+// A bare "*" therefore lists every key. A sigil is only recognised in
+// its position, so "~foo*" is a fuzzy search for "foo*" and "*foo" is an
+// exact lookup.
+func (t *Trie[T]) Query(q string) []string {
+	defer t.runlock(t.rlock())
+
+	switch {
+	case strings.HasPrefix(q, "~"):
+		return t.fuzzySearch(q[1:])
+	case strings.HasSuffix(q, "*"):
+		return t.prefixSearch(q[:len(q)-1])
+	}
+	if _, ok := t.find(q); ok {
+		return []string{q}
+	}
+	return nil
+}
+
+// MetaHistogram buckets every key by key(meta) and returns how many
+// keys fall in each bucket. key is called with the read lock held and
+// must not call back into the trie.
+func (t *Trie[T]) MetaHistogram(key func(T) string) map[string]int {
+	defer t.runlock(t.rlock())
+
+	hist := make(map[string]int)
+	eachTerminal(t.root, func(n *node[T]) bool {
+		hist[key(n.meta)]++
+		return true
+	})
+	return hist
+}
+
+// RandomKey returns a key drawn uniformly from the stored keys using
+// rng, descending from the root into each child with a probability
+// proportional to the number of keys beneath it. ok is false if the
+// trie is empty. Children are visited in rune order, so a given seed
+// always yields the same keys from the same trie.
+func (t *Trie[T]) RandomKey(rng *rand.Rand) (string, bool) {
+	defer t.runlock(t.rlock())
+
+	if t.size == 0 {
+		return "", false
+	}
+
+	nd := t.root
+	for {
+		r := rng.Intn(nd.termCount)
+		for _, c := range nd.SortedChildren() {
+			if c.term {
+				if r == 0 {
+					return c.path, true
+				}
+				r--
+				continue
+			}
+			if r < c.termCount {
+				nd = c
+				break
+			}
+			r -= c.termCount
+		}
+	}
+}
+
+// SamplePrefix returns up to n completions of `pre` drawn uniformly
+// without replacement using rng. The keys are reservoir sampled during
+// a single walk of the prefix's subtree rather than collected first,
+// and visited in lexical order so that a given seed always yields the
+// same sample from the same trie. The sample itself is in no particular
+// order.
+func (t *Trie[T]) SamplePrefix(pre string, n int, rng *rand.Rand) []string {
+	defer t.runlock(t.rlock())
+
+	nd := findNode(t.root, []rune(pre))
+	if nd == nil || n <= 0 {
+		return nil
+	}
+
+	sample := make([]string, 0, min(n, nd.termCount))
+	seen := 0
+	eachTerminalOrdered(nd, false, func(c *node[T]) bool {
+		seen++
+		if len(sample) < n {
+			sample = append(sample, c.path)
+		} else if j := rng.Intn(seen); j < n {
+			sample[j] = c.path
+		}
+		return true
+	})
+	return sample
+}
+
+// PrefixesOf returns the stored keys that are prefixes of `key`,
+// shortest first, including `key` itself when it is stored.
+func (t *Trie[T]) PrefixesOf(key string) []string {
+	defer t.runlock(t.rlock())
+
+	var keys []string
+	for _, n := range t.prefixesOf([]rune(key)) {
+		keys = append(keys, n.path)
+	}
+	return keys
+}
+
+// Segment splits s into a sequence of stored keys, reporting false if
+// that cannot be done. Where several segmentations exist it prefers
+// the one whose first key is longest, then likewise for the rest. An
+// empty s is the empty sequence.
+func (t *Trie[T]) Segment(s string) ([]string, bool) {
+	defer t.runlock(t.rlock())
+
+	// next[i] is where the key that segmentation of runes[i:] starts
+	// with ends, or 0 when runes[i:] cannot be segmented.
+	runes := []rune(s)
+	next := make([]int, len(runes)+1)
+	next[len(runes)] = len(runes)
+	for i := len(runes) - 1; i >= 0; i-- {
+		terms := t.prefixesOf(runes[i:])
+		for j := len(terms) - 1; j >= 0; j-- {
+			end := i + terms[j].depth - 1
+			if end > i && next[end] != 0 {
+				next[i] = end
+				break
+			}
+		}
+	}
+	if len(runes) > 0 && next[0] == 0 {
+		return nil, false
+	}
+
+	words := []string{}
+	for i := 0; i < len(runes); i = next[i] {
+		words = append(words, string(runes[i:next[i]]))
+	}
+	return words, true
+}
+
+// IsEmpty reports whether the trie holds no keys.
+func (t *Trie[T]) IsEmpty() bool {
+	defer t.runlock(t.rlock())
+
+	return t.size == 0
+}
+
+// AddUint stores the high bits of prefix, most significant first, as a
+// key of '0' and '1' runes with meta data meta, so that LookupUint can
+// find the longest stored prefix of a value as routing tables do for IP
+// ranges. An IPv4 CIDR block a.b.c.d/n, for instance, is added as
+// AddUint(uint64(ip)<<32, n, meta). Such keys are best kept in a trie
+// of their own. It panics unless 0 <= bits <= 64.
+func (t *Trie[T]) AddUint(prefix uint64, bits int, meta T) *node[T] {
+	if bits < 0 || bits > 64 {
+		panic("trie: AddUint needs between 0 and 64 bits")
+	}
+
+	t.lock()
+	defer t.unlock()
+
+	return t.add(string(uintBits(prefix)[:bits]), meta)
+}
+
+// LookupUint returns the meta data of the longest prefix stored with
+// AddUint that matches the high bits of value. ok is false if none
+// does.
+func (t *Trie[T]) LookupUint(value uint64) (meta T, ok bool) {
+	defer t.runlock(t.rlock())
+
+	terms := t.prefixesOf(uintBits(value))
+	if len(terms) == 0 {
+		return meta, false
+	}
+	return terms[len(terms)-1].meta, true
+}
+
+// ImmediateCompletions returns the stored keys that extend `pre` by
+// exactly one rune, in rune order. `pre` itself is not included.
+func (t *Trie[T]) ImmediateCompletions(pre string) []string {
+	defer t.runlock(t.rlock())
+
+	nd := findNode(t.root, []rune(pre))
+	if nd == nil {
+		return nil
+	}
+
+	var keys []string
+	for _, c := range nd.SortedChildren() {
+		if n, ok := c.Child(nul); ok && n.term {
+			keys = append(keys, n.path)
+		}
+	}
+	return keys
+}
+
+// Completion is a key completing a prefix along with the number of
+// runes past the prefix that it saves typing.
+type Completion struct {
+	Key   string
+	Saved int
+}
+
+// CompletionsWithSavings returns the keys starting with `pre`, `pre`
+// itself included with a Saved of zero, those saving the most typing
+// first and lexically among equals.
+func (t *Trie[T]) CompletionsWithSavings(pre string) []Completion {
+	defer t.runlock(t.rlock())
+
+	nd := findNode(t.root, []rune(pre))
+	if nd == nil {
+		return nil
+	}
+
+	var completions []Completion
+	eachTerminal(nd, func(n *node[T]) bool {
+		// A terminal sits one level below its key's last rune.
+		completions = append(completions, Completion{n.path, n.depth - 1 - nd.depth})
+		return true
+	})
+	sort.Slice(completions, func(i, j int) bool {
+		if completions[i].Saved != completions[j].Saved {
+			return completions[i].Saved > completions[j].Saved
+		}
+		return completions[i].Key < completions[j].Key
+	})
+	return completions
+}
+
+// ApproxBytes estimates the memory held by the trie's nodes: the node
+// structs themselves, their children maps and the key strings they
+// store. It is a rough guide for memory accounting rather than an exact
+// figure: map sizes are estimated from their length, strings are
+// counted in full even where they share memory with the caller's, and
+// memory referenced from meta data is not included.
+func (t *Trie[T]) ApproxBytes() int {
+	defer t.runlock(t.rlock())
+
+	total := 0
+	nodeSize := int(unsafe.Sizeof(node[T]{}))
+	nodes := []*node[T]{t.root}
+	for len(nodes) > 0 {
+		i := len(nodes) - 1
+		n := nodes[i]
+		nodes = nodes[:i]
+		total += nodeSize + len(n.path)
+		if n.children != nil {
+			total += mapHeaderBytes + n.numChildren()*mapEntryBytes
+		}
+		nodes = n.appendChildren(nodes)
+	}
+	return total
+}
+
+// mapHeaderBytes and mapEntryBytes approximate the cost of a children
+// map and of each of its entries, slack for growth included.
+const (
+	mapHeaderBytes = 48
+	mapEntryBytes  = 24
+)
+
+// newChild creates and returns a pointer to a new child for the node.
+func (n *node[T]) newChild(val rune, path string, bitmask uint64, meta T, term bool) *node[T] {
+	node := &node[T]{
+		val:      val,
+		path:     path,
+		mask:     bitmask,
+		term:     term,
+		meta:     meta,
+		parent:   n,
+		children: make(map[rune]*node[T]),
+		depth:    n.depth + 1,
+		gen:      n.gen,
+	}
+	n.setChild(node)
+	n.mask |= bitmask
+	return node
+}
+
+// newEmptyChild creates and returns a pointer to a new child for the node.
+func (n *node[T]) newEmptyChild(val rune, path string, bitmask uint64) *node[T] {
+	node := &node[T]{
+		val:      val,
+		path:     path,
+		mask:     bitmask,
+		parent:   n,
+		children: make(map[rune]*node[T]),
+		depth:    n.depth + 1,
+		gen:      n.gen,
+	}
+	n.setChild(node)
+	n.mask |= bitmask
+	return node
+}
+
+// removeTerminal detaches the terminal node n, pruning the intermediate
+// nodes that no longer lead to any key and recalculating termCounts and
+// bitmasks up to root.
+func (t *Trie[T]) removeTerminal(n *node[T]) {
+	t.logWAL(walRemove, n.path, n.meta)
+	t.untag(n)
+	t.size--
+	for p := t.own(n.parent); p != nil; p = p.parent {
+		p.termCount--
+	}
+	t.detach(n)
+}
+
+// detach removes the terminal n, which must no longer be counted in
+// size or termCount, along with the intermediate nodes that only led to
+// it, and recalculates bitmasks up to root.
+func (t *Trie[T]) detach(n *node[T]) {
+	t.own(n.parent)
+	if n.parent.numChildren() > 1 {
+		// The key is a prefix of others, which stay. Terminal markers
+		// contribute nothing to bitmasks, so only the marker goes.
+		n.parent.deleteChild(nul)
+		t.nodes--
+		return
+	}
+
+	nd, r := n.parent, n.val
+	for nd != t.root && nd.numChildren() == 1 {
+		nd, r = nd.parent, nd.val
+	}
+	// Everything from nd's child down to n is a single chain.
+	t.nodes -= n.depth - nd.depth
+	t.removeChild(nd, r)
+}
+
+// removeChild deletes the child r of n and recalculates the bitmasks
+// from n up to root.
+func (t *Trie[T]) removeChild(n *node[T], r rune) {
+	n.deleteChild(r)
+	for nd := n; nd != nil; nd = nd.parent {
+		nd.mask = t.maskruneslice([]rune{nd.val})
+		nd.eachChild(func(c *node[T]) bool {
+			nd.mask |= c.mask
+			return true
+		})
+	}
+}
+
+func findNode[T any](nd *node[T], runes []rune) *node[T] {
+	if nd == nil {
+		return nil
+	}
+
+	for _, r := range runes {
+		n, ok := nd.Child(r)
+		if !ok {
+			return nil
 		}
+		nd = n
+	}
+	return nd
+}
+
+// maskruneslice computes the bitmask of rs after applying the trie's
+// rune folding, if any.
+func (t *Trie[T]) maskruneslice(rs []rune) uint64 {
+	if t.fold == nil {
+		return maskruneslice(rs)
+	}
+
+	var m uint64
+	for _, r := range rs {
+		m |= uint64(1) << uint64(t.fold(r)-'a')
+	}
+	return m
+}
+
+// foldrunes returns rs with the trie's rune folding applied in place.
+func (t *Trie[T]) foldrunes(rs []rune) []rune {
+	if t.fold == nil {
+		return rs
+	}
+	for i, r := range rs {
+		rs[i] = t.fold(r)
+	}
+	return rs
+}
+
+func maskruneslice(rs []rune) uint64 {
+	var m uint64
+	for _, r := range rs {
+		m |= uint64(1) << uint64(r-'a')
+	}
+	return m
+}
+
+func collect[T any](nd *node[T]) []string {
+	keys := make([]string, 0, nd.termCount)
+	nodes := make([]*node[T], 1, nd.numChildren()+1)
+	nodes[0] = nd
+	for len(nodes) > 0 {
+		i := len(nodes) - 1
+		n := nodes[i]
+		nodes = nodes[:i]
+		nodes = n.appendChildren(nodes)
 		if n.term {
 			word := n.path
 			keys = append(keys, word)
@@ -258,18 +3108,70 @@ func collect[T any](nd *node[T]) []string {
 	return keys
 }
 
+// collectUntil appends the keys beneath nd to keys as collect does,
+// giving up once stop returns true. stop is polled every stopInterval
+// nodes. It reports whether every key was collected.
+func collectUntil[T any](nd *node[T], keys []string, stop func() bool) ([]string, bool) {
+	nodes := []*node[T]{nd}
+	for visited := 1; len(nodes) > 0; visited++ {
+		if visited%stopInterval == 0 && stop() {
+			return keys, false
+		}
+		i := len(nodes) - 1
+		n := nodes[i]
+		nodes = nodes[:i]
+		nodes = n.appendChildren(nodes)
+		if n.term {
+			keys = append(keys, n.path)
+		}
+	}
+	return keys, true
+}
+
 type potentialSubtree[T any] struct {
-	idx  int
-	node *node[T]
+	idx     int
+	node    *node[T]
+	matched []int
+}
+
+// fuzzycollect gathers the keys that contain `partial` as a subsequence.
+// When fold is non-nil it is applied to node runes before comparison;
+// `partial` is expected to be folded already.
+func fuzzycollect[T any](nd *node[T], partial []rune, fold func(rune) rune) []string {
+	keys := []string{}
+	fuzzywalk(nd, partial, fold, false, func(n *node[T], _ []int) bool {
+		keys = append(keys, collect(n)...)
+		return true
+	})
+	return keys
+}
+
+// fuzzywalk performs the fuzzycollect descent, calling fn with every
+// node at which the last rune of `partial` was matched; all keys in that
+// node's subtree are matches. When track is set, fn also receives the
+// rune indexes of the key at which `partial` matched. The walk stops
+// early when fn returns false, and fuzzywalk reports whether it finished.
+func fuzzywalk[T any](nd *node[T], partial []rune, fold func(rune) rune, track bool, fn func(*node[T], []int) bool) bool {
+	return fuzzywalkUntil(nd, partial, fold, track, nil, fn)
 }
 
-func fuzzycollect[T any](nd *node[T], partial []rune) (keys []string) {
+// stopInterval is how many nodes fuzzywalkUntil visits between calls to
+// stop.
+const stopInterval = 64
+
+// fuzzywalkUntil is fuzzywalk, additionally giving up once stop, when
+// non-nil, returns true. stop is polled every stopInterval nodes, so the
+// walk can be abandoned between matches as well as at them.
+func fuzzywalkUntil[T any](nd *node[T], partial []rune, fold func(rune) rune, track bool, stop func() bool, fn func(*node[T], []int) bool) bool {
 	if len(partial) == 0 {
-		return collect(nd)
+		return fn(nd, nil)
 	}
 
 	potential := []potentialSubtree[T]{{node: nd, idx: 0}}
-	for len(potential) > 0 {
+	for visited := 1; len(potential) > 0; visited++ {
+		if stop != nil && visited%stopInterval == 0 && stop() {
+			return false
+		}
 		i := len(potential) - 1
 		p := potential[i]
 		potential = potential[:i]
@@ -278,17 +3180,755 @@ func fuzzycollect[T any](nd *node[T], partial []rune) (keys []string) {
 			continue
 		}
 
-		if p.node.val == partial[p.idx] {
+		val := p.node.val
+		if fold != nil {
+			val = fold(val)
+		}
+		if val == partial[p.idx] {
 			p.idx++
+			if track {
+				// Siblings share the parent's slice, so force a copy.
+				p.matched = append(p.matched[:len(p.matched):len(p.matched)], p.node.depth-1)
+			}
 			if p.idx == len(partial) {
-				keys = append(keys, collect(p.node)...)
+				if !fn(p.node, p.matched) {
+					return false
+				}
 				continue
 			}
 		}
 
-		for _, c := range p.node.children {
-			potential = append(potential, potentialSubtree[T]{node: c, idx: p.idx})
+		p.node.eachChild(func(c *node[T]) bool {
+			potential = append(potential, potentialSubtree[T]{node: c, idx: p.idx, matched: p.matched})
+			return true
+		})
+	}
+	return true
+}
+
+// eachTerminal calls fn for every terminal node beneath nd, stopping
+// early when fn returns false. It reports whether the walk completed.
+func eachTerminal[T any](nd *node[T], fn func(*node[T]) bool) bool {
+	nodes := []*node[T]{nd}
+	for len(nodes) > 0 {
+		i := len(nodes) - 1
+		n := nodes[i]
+		nodes = nodes[:i]
+		nodes = n.appendChildren(nodes)
+		if n.term && !fn(n) {
+			return false
+		}
+	}
+	return true
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// countingReader reads a byte at a time so that the reported count is
+// exactly what was consumed from the underlying reader.
+type countingReader struct {
+	r   io.Reader
+	n   int64
+	buf [1]byte
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+func (cr *countingReader) ReadByte() (byte, error) {
+	if _, err := io.ReadFull(cr, cr.buf[:]); err != nil {
+		return 0, err
+	}
+	return cr.buf[0], nil
+}
+
+var errChunkTooLarge = errors.New("trie: record exceeds maximum length")
+
+const maxChunk = 1 << 30
+
+func writeUvarint(w io.Writer, v uint64) error {
+	var buf [binary.MaxVarintLen64]byte
+	_, err := w.Write(buf[:binary.PutUvarint(buf[:], v)])
+	return err
+}
+
+func writeChunk(w io.Writer, p []byte) error {
+	if err := writeUvarint(w, uint64(len(p))); err != nil {
+		return err
+	}
+	_, err := w.Write(p)
+	return err
+}
+
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+func readChunk(r byteReader) ([]byte, error) {
+	l, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if l > maxChunk {
+		return nil, errChunkTooLarge
+	}
+	p := make([]byte, l)
+	if _, err := io.ReadFull(r, p); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return p, nil
+}
+
+var diacritics = func() map[rune]rune {
+	table := []struct {
+		base   rune
+		marked string
+	}{
+		{'a', "ÀÁÂÃÄÅĀĂĄàáâãäåāăą"},
+		{'c', "ÇĆĈĊČçćĉċč"},
+		{'d', "ĎĐďđ"},
+		{'e', "ÈÉÊËĒĔĖĘĚèéêëēĕėęě"},
+		{'g', "ĜĞĠĢĝğġģ"},
+		{'h', "ĤĦĥħ"},
+		{'i', "ÌÍÎÏĨĪĬĮİìíîïĩīĭįı"},
+		{'j', "Ĵĵ"},
+		{'k', "Ķķ"},
+		{'l', "ĹĻĽĿŁĺļľŀł"},
+		{'n', "ÑŃŅŇñńņň"},
+		{'o', "ÒÓÔÕÖØŌŎŐòóôõöøōŏő"},
+		{'r', "ŔŖŘŕŗř"},
+		{'s', "ŚŜŞŠśŝşš"},
+		{'t', "ŢŤŦţťŧ"},
+		{'u', "ÙÚÛÜŨŪŬŮŰŲùúûüũūŭůűų"},
+		{'w', "Ŵŵ"},
+		{'y', "ÝŶŸýÿŷ"},
+		{'z', "ŹŻŽźżž"},
+	}
+
+	m := make(map[rune]rune)
+	for _, e := range table {
+		for _, r := range e.marked {
+			m[r] = e.base
 		}
 	}
+	return m
+}()
+
+// foldDiacritic maps a letter to its lower case, unaccented form.
+func foldDiacritic(r rune) rune {
+	if b, ok := diacritics[r]; ok {
+		return b
+	}
+	return unicode.ToLower(r)
+}
+
+// collectOrdered is like collect but visits children in rune order, so
+// keys come out in ascending lexical order, or descending when desc is
+// set, without a separate sort.
+func collectOrdered[T any](nd *node[T], desc bool) []string {
+	keys := make([]string, 0, nd.termCount)
+	eachTerminalOrdered(nd, desc, func(n *node[T]) bool {
+		keys = append(keys, n.path)
+		return true
+	})
 	return keys
 }
+
+// eachTerminalOrdered is eachTerminal visiting keys in ascending
+// lexical order, or descending when desc is set.
+func eachTerminalOrdered[T any](nd *node[T], desc bool, fn func(*node[T]) bool) bool {
+	nodes := []*node[T]{nd}
+	for len(nodes) > 0 {
+		i := len(nodes) - 1
+		n := nodes[i]
+		nodes = nodes[:i]
+		if n.term && !fn(n) {
+			return false
+		}
+
+		// The stack pops the last child first, so push in reverse.
+		nodes = n.appendChildren(nodes)
+		kids := nodes[i:]
+		if desc {
+			sort.Slice(kids, func(i, j int) bool { return kids[i].val < kids[j].val })
+		} else {
+			sort.Slice(kids, func(i, j int) bool { return kids[i].val > kids[j].val })
+		}
+	}
+	return true
+}
+
+const (
+	walAdd    byte = 'a'
+	walRemove byte = 'r'
+)
+
+var errBadWALRecord = errors.New("trie: unknown write-ahead log record")
+
+// logWAL appends an operation to the write-ahead log, if one is
+// enabled. It must be called with the write lock held.
+func (t *Trie[T]) logWAL(op byte, key string, meta T) {
+	if t.wal == nil || t.walErr != nil {
+		return
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(op)
+	writeChunk(&buf, []byte(key))
+	if op == walAdd {
+		writeChunk(&buf, t.encodeMeta(meta))
+	}
+	_, t.walErr = t.wal.Write(buf.Bytes())
+}
+
+// editwalk walks the trie beneath nd computing, one Levenshtein row per
+// node, the edit distance between every node's path and query: row[j]
+// is the distance to query[:j], so row[len(query)] is the distance to
+// all of query. Terminal nodes share their parent's row. visit returns
+// the largest distance still of interest; subtrees whose rows exceed
+// it are pruned, since a row's minimum never shrinks further down.
+func editwalk[T any](nd *node[T], query []rune, visit func(n *node[T], row []int) int) {
+	type frame struct {
+		node *node[T]
+		row  []int
+	}
+
+	row := make([]int, len(query)+1)
+	for j := range row {
+		row[j] = j
+	}
+
+	stack := []frame{{nd, row}}
+	var kids []*node[T]
+	for len(stack) > 0 {
+		i := len(stack) - 1
+		f := stack[i]
+		stack = stack[:i]
+
+		bound := visit(f.node, f.row)
+		if minint(f.row) > bound {
+			continue
+		}
+
+		kids = f.node.appendChildren(kids[:0])
+		for _, c := range kids {
+			r := c.val
+			if r == nul {
+				stack = append(stack, frame{c, f.row})
+				continue
+			}
+			next := make([]int, len(f.row))
+			next[0] = f.row[0] + 1
+			for j := 1; j < len(next); j++ {
+				cost := 1
+				if query[j-1] == r {
+					cost = 0
+				}
+				next[j] = min(f.row[j]+1, next[j-1]+1, f.row[j-1]+cost)
+			}
+			stack = append(stack, frame{c, next})
+		}
+	}
+}
+
+func minint(xs []int) int {
+	m := xs[0]
+	for _, x := range xs[1:] {
+		m = min(m, x)
+	}
+	return m
+}
+
+// parsePattern compiles a PatternSearch pattern into one matcher per
+// rune position.
+func parsePattern(pat []rune) []func(rune) bool {
+	var matchers []func(rune) bool
+	for i := 0; i < len(pat); i++ {
+		switch r := pat[i]; {
+		case r == '?':
+			matchers = append(matchers, func(rune) bool { return true })
+		case r == '\\' && i+1 < len(pat):
+			i++
+			lit := pat[i]
+			matchers = append(matchers, func(r rune) bool { return r == lit })
+		case r == '[':
+			m, end := parseClass(pat, i)
+			if end < 0 {
+				matchers = append(matchers, func(r rune) bool { return r == '[' })
+				continue
+			}
+			matchers = append(matchers, m)
+			i = end
+		default:
+			matchers = append(matchers, func(c rune) bool { return c == r })
+		}
+	}
+	return matchers
+}
+
+// parseClass parses the class opening at pat[start], returning its
+// matcher and the index of the closing ']', or -1 if there is none.
+func parseClass(pat []rune, start int) (func(rune) bool, int) {
+	type span struct{ lo, hi rune }
+
+	var (
+		spans  []span
+		negate bool
+		i      = start + 1
+	)
+	if i < len(pat) && pat[i] == '^' {
+		negate = true
+		i++
+	}
+	for ; i < len(pat); i++ {
+		r := pat[i]
+		if r == ']' && len(spans) > 0 {
+			return func(c rune) bool {
+				for _, s := range spans {
+					if c >= s.lo && c <= s.hi {
+						return !negate
+					}
+				}
+				return negate
+			}, i
+		}
+		if r == '\\' && i+1 < len(pat) {
+			i++
+			r = pat[i]
+		}
+		if i+2 < len(pat) && pat[i+1] == '-' && pat[i+2] != ']' {
+			spans = append(spans, span{r, pat[i+2]})
+			i += 2
+			continue
+		}
+		spans = append(spans, span{r, r})
+	}
+	return nil, -1
+}
+
+// prefixCounts returns the termCount of every node depth runes below
+// nd, where pre is the path leading to nd.
+func prefixCounts[T any](nd *node[T], pre []rune, depth int) []PrefixCount {
+	type frame struct {
+		node *node[T]
+		path []rune
+	}
+
+	var counts []PrefixCount
+	stack := []frame{{nd, pre}}
+	for len(stack) > 0 {
+		i := len(stack) - 1
+		f := stack[i]
+		stack = stack[:i]
+		if f.node.termCount == 0 {
+			// Only soft-deleted keys are left beneath it.
+			continue
+		}
+		if len(f.path)-len(pre) == depth {
+			counts = append(counts, PrefixCount{string(f.path), f.node.termCount})
+			continue
+		}
+		f.node.eachChild(func(c *node[T]) bool {
+			if c.val != nul {
+				path := append(f.path[:len(f.path):len(f.path)], c.val)
+				stack = append(stack, frame{c, path})
+			}
+			return true
+		})
+	}
+	return counts
+}
+
+// missCache is a fixed size LRU set of keys Find failed to find. It has
+// its own lock because Find only holds the trie's read lock.
+type missCache struct {
+	mu    sync.Mutex
+	size  int
+	order *list.List
+	keys  map[string]*list.Element
+}
+
+func newMissCache(size int) *missCache {
+	return &missCache{
+		size:  size,
+		order: list.New(),
+		keys:  make(map[string]*list.Element, size),
+	}
+}
+
+func (c *missCache) contains(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.keys[key]
+	if ok {
+		c.order.MoveToFront(e)
+	}
+	return ok
+}
+
+func (c *missCache) add(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.keys[key]; ok {
+		c.order.MoveToFront(e)
+		return
+	}
+	c.keys[key] = c.order.PushFront(key)
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.keys, oldest.Value.(string))
+	}
+}
+
+func (c *missCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.keys[key]; ok {
+		c.order.Remove(e)
+		delete(c.keys, key)
+	}
+}
+
+// untag drops the terminal node n from the tag index.
+func (t *Trie[T]) untag(n *node[T]) {
+	for tag, nodes := range t.tags {
+		delete(nodes, n)
+		if len(nodes) == 0 {
+			delete(t.tags, tag)
+		}
+	}
+}
+
+// retag moves the tags of the terminal n to its copy c.
+func (t *Trie[T]) retag(n, c *node[T]) {
+	for _, nodes := range t.tags {
+		if _, ok := nodes[n]; ok {
+			delete(nodes, n)
+			nodes[c] = struct{}{}
+		}
+	}
+}
+
+// subseqwalk calls fn with every key beneath nd and the fewest edits to
+// query (substituting or dropping its runes) after which query is a
+// subsequence of the key, as long as that is at most maxDist. Runes are
+// folded with fold when it is set; query is expected to be folded
+// already. Subtrees whose bitmask lacks more of query's runes than
+// maxDist allows are skipped.
+func subseqwalk[T any](nd *node[T], query []rune, fold func(rune) rune, maxDist int, fn func(*node[T], int)) {
+	type frame struct {
+		node *node[T]
+		row  []int
+	}
+
+	row := make([]int, len(query)+1)
+	for j := range row {
+		row[j] = j
+	}
+
+	stack := []frame{{nd, row}}
+	var kids []*node[T]
+	for len(stack) > 0 {
+		i := len(stack) - 1
+		f := stack[i]
+		stack = stack[:i]
+		if f.node.term {
+			if f.row[len(query)] <= maxDist {
+				fn(f.node, f.row[len(query)])
+			}
+			continue
+		}
+
+		kids = f.node.appendChildren(kids[:0])
+		for _, c := range kids {
+			r := c.val
+			if r == nul {
+				stack = append(stack, frame{c, f.row})
+				continue
+			}
+			if fold != nil {
+				r = fold(r)
+			}
+			next := make([]int, len(f.row))
+			for j := 1; j < len(next); j++ {
+				cost := 1
+				if query[j-1] == r {
+					cost = 0
+				}
+				// Skipping a rune of the key is free; using it to match
+				// or substitute, or dropping a rune of query, is not.
+				next[j] = min(f.row[j], f.row[j-1]+cost, next[j-1]+1)
+			}
+			if subseqReachable(next, query, c.mask, maxDist) {
+				stack = append(stack, frame{c, next})
+			}
+		}
+	}
+}
+
+// subseqReachable reports whether a key beneath a node with the given
+// mask could be within maxDist edits of query, where row holds the
+// edits for each prefix of query against the path to the node. Each
+// rune of the rest of query that mask lacks has to be substituted or
+// dropped.
+func subseqReachable(row []int, query []rune, mask uint64, maxDist int) bool {
+	missing := 0
+	for j := len(query); j >= 0; j-- {
+		if row[j]+missing <= maxDist {
+			return true
+		}
+		if j > 0 {
+			if m := maskruneslice(query[j-1 : j]); mask&m != m {
+				missing++
+			}
+		}
+	}
+	return false
+}
+
+// rlock takes the read lock unless the trie is frozen, reporting
+// whether it did. It pairs with runlock as
+//
+//	defer t.runlock(t.rlock())
+func (t *Trie[T]) rlock() bool {
+	if t.frozen.Load() {
+		return false
+	}
+	t.mu.RLock()
+	return true
+}
+
+// runlock releases the read lock if rlock took it.
+func (t *Trie[T]) runlock(locked bool) {
+	if locked {
+		t.mu.RUnlock()
+	}
+}
+
+// lock takes the write lock, panicking with ErrFrozen if the trie is
+// frozen. Checking after acquiring the lock catches a Freeze that won
+// the race for it.
+func (t *Trie[T]) lock() {
+	t.mu.Lock()
+	if t.frozen.Load() {
+		t.mu.Unlock()
+		panic(ErrFrozen)
+	}
+}
+
+// unlock publishes the write's root and releases the write lock.
+func (t *Trie[T]) unlock() {
+	t.publish()
+	t.mu.Unlock()
+}
+
+// publish makes root visible to the reads that take no lock and starts
+// a new write, so that nodes created so far are copied before they are
+// next modified.
+func (t *Trie[T]) publish() {
+	if t.lockFree {
+		t.published.Store(t.root)
+		t.gen++
+	}
+}
+
+// own returns n if the current write created it or the trie was not
+// created WithLockFreeReads, and otherwise a copy of n that takes its
+// place in the trie, copying n's ancestors in turn. Callers must use
+// the copy from then on. n's children stay shared and are moved under
+// the copy by rewriting their parent pointers. That is the one change
+// made to published nodes, and it holds only as long as the reads that
+// take no lock never follow parent.
+func (t *Trie[T]) own(n *node[T]) *node[T] {
+	if !t.lockFree || n.gen == t.gen {
+		return n
+	}
+
+	c := *n
+	c.gen = t.gen
+	if n.children != nil {
+		c.children = maps.Clone(n.children)
+	}
+	cp := &c
+	cp.eachChild(func(k *node[T]) bool {
+		k.parent = cp
+		return true
+	})
+	if n.parent == nil {
+		t.root = cp
+	} else {
+		cp.parent = t.own(n.parent)
+		cp.parent.setChild(cp)
+	}
+	if n.term || n.deleted {
+		t.retag(n, cp)
+	}
+	return cp
+}
+
+// ownEach owns every node of the trie, for writes that may change any
+// of them, calling fn with each before any of its children.
+func (t *Trie[T]) ownEach(fn func(n *node[T])) {
+	nodes := []*node[T]{t.root}
+	for len(nodes) > 0 {
+		i := len(nodes) - 1
+		n := t.own(nodes[i])
+		nodes = n.appendChildren(nodes[:i])
+		fn(n)
+	}
+}
+
+// postorder calls fn with every node, each after all of its children,
+// by walking the nodes depth first and then calling fn in the reverse
+// order. Writes pass own so that fn only sees nodes they own; reads
+// must not, since owning modifies the trie.
+func (t *Trie[T]) postorder(own bool, fn func(n *node[T])) {
+	var order []*node[T]
+	nodes := []*node[T]{t.root}
+	for len(nodes) > 0 {
+		i := len(nodes) - 1
+		n := nodes[i]
+		if own {
+			n = t.own(n)
+		}
+		nodes = n.appendChildren(nodes[:i])
+		order = append(order, n)
+	}
+	for i := len(order) - 1; i >= 0; i-- {
+		fn(order[i])
+	}
+}
+
+// revive restores the soft-deleted terminal n, which the current
+// write must own.
+func (t *Trie[T]) revive(n *node[T]) {
+	t.logWAL(walAdd, n.path, n.meta)
+	if t.misses != nil {
+		t.misses.remove(n.path)
+	}
+	n.term, n.deleted = true, false
+	t.size++
+	for p := n.parent; p != nil; p = p.parent {
+		p.termCount++
+	}
+}
+
+// addFold chains f after the trie's rune folding, if any.
+func (t *Trie[T]) addFold(f func(rune) rune) {
+	prev := t.fold
+	if prev == nil {
+		t.fold = f
+		return
+	}
+	t.fold = func(r rune) rune { return f(prev(r)) }
+}
+
+// shrink rebuilds every children map at its exact size, dropping the
+// empty maps of all nodes but the root, and reports how many it dropped.
+func (t *Trie[T]) shrink() int {
+	dropped := 0
+	t.ownEach(func(n *node[T]) {
+		if n.numChildren() == 0 && n != t.root {
+			if n.children != nil {
+				n.children = nil
+				dropped++
+			}
+			return
+		}
+
+		children := make(map[rune]*node[T], n.numChildren())
+		for r, c := range n.children {
+			children[r] = c
+		}
+		n.children = children
+	})
+	return dropped
+}
+
+// mapNode copies n beneath parent, passing its meta data through f. The
+// children are left for the caller to copy.
+func mapNode[A, B any](n *node[A], parent *node[B], f func(A) B) *node[B] {
+	m := &node[B]{
+		val:       n.val,
+		path:      n.path,
+		term:      n.term,
+		depth:     n.depth,
+		mask:      n.mask,
+		parent:    parent,
+		children:  make(map[rune]*node[B], n.numChildren()),
+		termCount: n.termCount,
+		hasMeta:   n.hasMeta,
+		deleted:   n.deleted,
+	}
+	if n.term || n.deleted || n.hasMeta {
+		m.meta = f(n.meta)
+	}
+	return m
+}
+
+// prefixesOf returns the terminals of the stored keys that are prefixes
+// of runes, shortest first. A terminal's depth less one is the length
+// of its key.
+func (t *Trie[T]) prefixesOf(runes []rune) []*node[T] {
+	var terms []*node[T]
+	nd := t.root
+	for i := 0; ; i++ {
+		if n, ok := nd.Child(nul); ok && n.term {
+			terms = append(terms, n)
+		}
+		if i == len(runes) {
+			return terms
+		}
+		c, ok := nd.Child(runes[i])
+		if !ok {
+			return terms
+		}
+		nd = c
+	}
+}
+
+func (t *Trie[T]) observeAdd(start time.Time) {
+	t.observer.ObserveAdd(time.Since(start))
+}
+
+func (t *Trie[T]) observeFind(start time.Time, hit *bool) {
+	t.observer.ObserveFind(*hit, time.Since(start))
+}
+
+func (t *Trie[T]) observeRemove(start time.Time, found *bool) {
+	t.observer.ObserveRemove(*found, time.Since(start))
+}
+
+func (t *Trie[T]) observeSearch(method string, start time.Time, keys *[]string) {
+	t.observer.ObserveSearch(method, len(*keys), time.Since(start))
+}
+
+// uintBits spells out the bits of v, most significant first, as '0' and
+// '1' runes.
+func uintBits(v uint64) []rune {
+	bits := make([]rune, 64)
+	for i := range bits {
+		bits[i] = '0' + rune(v>>(63-i)&1)
+	}
+	return bits
+}
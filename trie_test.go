@@ -2,10 +2,24 @@ package trie
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"math/rand"
 	"os"
+	"runtime"
+	"slices"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+	"unicode/utf8"
 )
 
 func createTrieAndAddFromFile[T any](path string, val T) *Trie[T] {
@@ -348,6 +362,24 @@ func BenchmarkPrefixSearch(b *testing.B) {
 	}
 }
 
+func BenchmarkOrderedPrefixSearch(b *testing.B) {
+	trie := createTrieAndAddFromFile[interface{}]("/usr/share/dict/words", nil)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = trie.OrderedPrefixSearch("fo")
+	}
+}
+
+func BenchmarkPrefixSearchThenSort(b *testing.B) {
+	trie := createTrieAndAddFromFile[interface{}]("/usr/share/dict/words", nil)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sort.Strings(trie.PrefixSearch("fo"))
+	}
+}
+
 func BenchmarkFuzzySearch(b *testing.B) {
 	trie := createTrieAndAddFromFile[interface{}]("/usr/share/dict/words", nil)
 
@@ -357,12 +389,84 @@ func BenchmarkFuzzySearch(b *testing.B) {
 	}
 }
 
+func BenchmarkFuzzySearchAtLeast(b *testing.B) {
+	trie := createTrieAndAddFromFile[interface{}]("/usr/share/dict/words", nil)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = trie.FuzzySearchAtLeast("jazzy", 10)
+	}
+}
+
 func BenchmarkBuildTree(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		createTrieAndAddFromFile[interface{}]("/usr/share/dict/words", nil)
 	}
 }
 
+func BenchmarkBuildTreeWithCapacity(b *testing.B) {
+	words := createTrieAndAddFromFile[interface{}]("/usr/share/dict/words", nil).Keys()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		trie := NewWithCapacity[interface{}](len(words))
+		for _, word := range words {
+			trie.Add(word, nil)
+		}
+	}
+}
+
+// benchmarkBuildTreeRetained builds the dictionary with a slice of meta
+// data per key and reports, besides allocations, the heap still held
+// once the trie is built, which is what WithKeysOnly saves.
+func benchmarkBuildTreeRetained(b *testing.B, opts ...Option[interface{}]) {
+	words := createTrieAndAddFromFile[interface{}]("/usr/share/dict/words", nil).Keys()
+
+	var retained uint64
+	var before, after runtime.MemStats
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		b.StartTimer()
+
+		trie := New(opts...)
+		for _, word := range words {
+			trie.Add(word, []byte(word))
+		}
+
+		b.StopTimer()
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		runtime.KeepAlive(trie)
+		retained += after.HeapAlloc - before.HeapAlloc
+		b.StartTimer()
+	}
+	b.ReportMetric(float64(retained)/float64(b.N), "retained-B/op")
+}
+
+func BenchmarkBuildTreeKeysOnly(b *testing.B) {
+	benchmarkBuildTreeRetained(b, WithKeysOnly[interface{}]())
+}
+
+func BenchmarkBuildTreeWithMeta(b *testing.B) {
+	benchmarkBuildTreeRetained(b)
+}
+
+func BenchmarkBuildTreeWithoutCapacity(b *testing.B) {
+	words := createTrieAndAddFromFile[interface{}]("/usr/share/dict/words", nil).Keys()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		trie := New[interface{}]()
+		for _, word := range words {
+			trie.Add(word, nil)
+		}
+	}
+}
+
 func TestSupportChinese(t *testing.T) {
 	trie := New[interface{}]()
 	expected := []string{"苹果 沂水县", "苹果", "大蒜", "大豆"}
@@ -397,7 +501,12 @@ func TestSupportChinese(t *testing.T) {
 	}
 }
 
-func BenchmarkAdd(b *testing.B) {
+func BenchmarkAdd(b *testing.B) { benchmarkAdd(b) }
+
+// BenchmarkAddLockFree shows what copying each written path costs.
+func BenchmarkAddLockFree(b *testing.B) { benchmarkAdd(b, WithLockFreeReads[interface{}]()) }
+
+func benchmarkAdd(b *testing.B, opts ...Option[interface{}]) {
 	f, err := os.Open("/usr/share/dict/words")
 	if err != nil {
 		b.Fatal("couldn't open bag of words")
@@ -412,8 +521,3642 @@ func BenchmarkAdd(b *testing.B) {
 		words = append(words, word)
 	}
 	b.ResetTimer()
-	trie := New[interface{}]()
+	trie := New(opts...)
 	for i := 0; i < b.N; i++ {
 		trie.Add(words[i%len(words)], nil)
 	}
 }
+
+func TestGroupByNextRune(t *testing.T) {
+	trie := New[interface{}]()
+	for _, key := range []string{"car", "cat", "cab", "dog"} {
+		trie.Add(key, nil)
+	}
+
+	groups := trie.GroupByNextRune("ca")
+	if len(groups) != 3 {
+		t.Fatalf("Expected 3 groups, got %d: %v", len(groups), groups)
+	}
+	for r, expected := range map[rune]string{'r': "car", 't': "cat", 'b': "cab"} {
+		keys := groups[r]
+		if len(keys) != 1 || keys[0] != expected {
+			t.Errorf("Expected group %q to be [%s], got %v", r, expected, keys)
+		}
+	}
+
+	groups = trie.GroupByNextRune("")
+	if len(groups['c']) != 3 || len(groups['d']) != 1 {
+		t.Errorf("Expected groups c:3 d:1, got %v", groups)
+	}
+
+	groups = trie.GroupByNextRune("zzz")
+	if groups == nil || len(groups) != 0 {
+		t.Errorf("Expected empty map for unknown prefix, got %#v", groups)
+	}
+}
+
+func TestWriteToReadFrom(t *testing.T) {
+	trie := New[int]()
+	expected := map[string]int{"foo": 1, "foobar": 2, "bar": 3, "苹果": 4}
+	for key, meta := range expected {
+		trie.Add(key, meta)
+	}
+
+	var buf bytes.Buffer
+	written, err := trie.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written != int64(buf.Len()) {
+		t.Errorf("Expected WriteTo to report %d bytes, got %d", buf.Len(), written)
+	}
+
+	total := int64(buf.Len())
+	restored := New[int]()
+	read, err := restored.ReadFrom(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read != total {
+		t.Errorf("Expected ReadFrom to report %d bytes, got %d", total, read)
+	}
+
+	keys := restored.Keys()
+	if len(keys) != len(expected) {
+		t.Fatalf("Expected %d keys, got %v", len(expected), keys)
+	}
+	for key, meta := range expected {
+		n, ok := restored.Find(key)
+		if !ok {
+			t.Errorf("Expected to find %s", key)
+			continue
+		}
+		if n.meta != meta {
+			t.Errorf("Expected meta %d for %s, got %d", meta, key, n.meta)
+		}
+	}
+}
+
+func TestReadFromTruncated(t *testing.T) {
+	trie := New[int]()
+	trie.Add("foo", 1)
+
+	var buf bytes.Buffer
+	if _, err := trie.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	truncated := bytes.NewReader(buf.Bytes()[:buf.Len()-1])
+	if _, err := New[int]().ReadFrom(truncated); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+func TestShortestUniquePrefix(t *testing.T) {
+	trie := New[int]()
+	for _, key := range []string{"apple", "apply", "app", "banana"} {
+		trie.Add(key, 0)
+	}
+	// Re-adding a key must not make its prefixes look shared.
+	trie.Add("banana", 1)
+
+	tests := []struct {
+		key      string
+		expected string
+		ok       bool
+	}{
+		{"apple", "apple", true},
+		{"apply", "apply", true},
+		{"app", "app", true},
+		{"banana", "b", true},
+		{"appl", "", false},
+		{"cherry", "", false},
+	}
+
+	for _, test := range tests {
+		actual, ok := trie.ShortestUniquePrefix(test.key)
+		if ok != test.ok || actual != test.expected {
+			t.Errorf("ShortestUniquePrefix(%q): expected (%q, %t), got (%q, %t)",
+				test.key, test.expected, test.ok, actual, ok)
+		}
+	}
+}
+
+func TestTrieAddDuplicate(t *testing.T) {
+	trie := New[int]()
+	trie.Add("foo", 1)
+	trie.Add("foo", 2)
+
+	if trie.size != 1 {
+		t.Errorf("Expected size 1, got %d", trie.size)
+	}
+	if trie.root.termCount != 1 {
+		t.Errorf("Expected root termCount 1, got %d", trie.root.termCount)
+	}
+	n, ok := trie.Find("foo")
+	if !ok || n.meta != 2 {
+		t.Errorf("Expected meta to be replaced with 2, got %v", n)
+	}
+}
+
+func TestFuzzySearchDiacriticFolding(t *testing.T) {
+	trie := New[interface{}](WithDiacriticFolding[interface{}]())
+	for _, key := range []string{"José", "Zoë", "jam"} {
+		trie.Add(key, nil)
+	}
+
+	tests := []struct {
+		partial  string
+		expected []string
+	}{
+		{"jose", []string{"José"}},
+		{"JOSÉ", []string{"José"}},
+		{"zoe", []string{"Zoë"}},
+		{"ja", []string{"jam"}},
+		{"jx", nil},
+	}
+
+	for _, test := range tests {
+		actual := trie.FuzzySearch(test.partial)
+		if len(actual) != len(test.expected) {
+			t.Errorf("FuzzySearch(%q): expected %v, got %v", test.partial, test.expected, actual)
+			continue
+		}
+		for i := range actual {
+			if actual[i] != test.expected[i] {
+				t.Errorf("FuzzySearch(%q): expected %v, got %v", test.partial, test.expected, actual)
+			}
+		}
+	}
+
+	plain := New[interface{}]()
+	plain.Add("José", nil)
+	if keys := plain.FuzzySearch("jose"); len(keys) != 0 {
+		t.Errorf("Expected no folding by default, got %v", keys)
+	}
+}
+
+func TestRemoveIf(t *testing.T) {
+	trie := New[bool]()
+	setup := map[string]bool{
+		"foo":      true,
+		"foobar":   false,
+		"football": true,
+		"bar":      false,
+		"baz":      true,
+	}
+	for key, stale := range setup {
+		trie.Add(key, stale)
+	}
+
+	removed := trie.RemoveIf(func(key string, stale bool) bool { return stale })
+	if removed != 3 {
+		t.Errorf("Expected 3 keys removed, got %d", removed)
+	}
+	if trie.size != 2 || trie.root.termCount != 2 {
+		t.Errorf("Expected size and root termCount of 2, got %d and %d", trie.size, trie.root.termCount)
+	}
+
+	keys := trie.Keys()
+	sort.Strings(keys)
+	if len(keys) != 2 || keys[0] != "bar" || keys[1] != "foobar" {
+		t.Errorf("Expected [bar foobar], got %v", keys)
+	}
+
+	if fuzzy := trie.FuzzySearch("ft"); len(fuzzy) != 0 {
+		t.Errorf("Expected stale masks to be cleared, got %v", fuzzy)
+	}
+	if fuzzy := trie.FuzzySearch("fb"); len(fuzzy) != 1 || fuzzy[0] != "foobar" {
+		t.Errorf("Expected [foobar], got %v", fuzzy)
+	}
+	if trie.root.mask&maskruneslice([]rune("z")) != 0 {
+		t.Errorf("Expected root mask to drop 'z' after removing baz")
+	}
+}
+
+func TestRemoveKeepsSiblingsAtRoot(t *testing.T) {
+	trie := New[int]()
+	trie.Add("abc", 1)
+	trie.Add("xyz", 2)
+
+	trie.Remove("abc")
+	if _, ok := trie.Find("xyz"); !ok {
+		t.Error("Expected xyz to survive removal of abc")
+	}
+	if trie.size != 1 {
+		t.Errorf("Expected size 1, got %d", trie.size)
+	}
+}
+
+func TestEach(t *testing.T) {
+	trie := New[int]()
+	setup := map[string]int{"foo": 1, "foobar": 2, "bar": 3}
+	for key, meta := range setup {
+		trie.Add(key, meta)
+	}
+
+	visited := 0
+	trie.Each(func(key string, meta *int) {
+		visited++
+		*meta *= 2
+	})
+	if visited != len(setup) {
+		t.Errorf("Expected %d keys visited, got %d", len(setup), visited)
+	}
+
+	for key, meta := range setup {
+		n, ok := trie.Find(key)
+		if !ok || n.meta != meta*2 {
+			t.Errorf("Expected %s to have meta %d, got %v", key, meta*2, n)
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	trie := New[interface{}]()
+	for _, key := range []string{"foosball", "football", "foo", "bfrza", "frosty"} {
+		trie.Add(key, nil)
+	}
+
+	tests := []struct {
+		query    string
+		expected []string
+	}{
+		// "foo" is a real prefix, so only its completions are returned
+		// even though "frosty" would fuzzy match.
+		{"foo", []string{"foo", "foosball", "football"}},
+		{"fo", []string{"foo", "foosball", "football"}},
+		{"fz", []string{"bfrza"}},
+		{"fy", []string{"frosty"}},
+		{"fq", nil},
+	}
+
+	for _, test := range tests {
+		actual := trie.Search(test.query)
+		if len(actual) != len(test.expected) {
+			t.Errorf("Search(%q): expected %v, got %v", test.query, test.expected, actual)
+			continue
+		}
+		sort.Strings(actual)
+		for i := range actual {
+			if actual[i] != test.expected[i] {
+				t.Errorf("Search(%q): expected %v, got %v", test.query, test.expected, actual)
+			}
+		}
+	}
+
+	if keys := New[interface{}]().Search("foo"); keys != nil {
+		t.Errorf("Expected nil from empty trie, got %v", keys)
+	}
+}
+
+func TestPrefixMeta(t *testing.T) {
+	trie := New[string]()
+	trie.Add("foobar", "key")
+
+	if _, ok := trie.GetPrefixMeta("foo"); ok {
+		t.Error("Expected no prefix meta before SetPrefixMeta")
+	}
+
+	trie.SetPrefixMeta("foo", "rollup")
+	meta, ok := trie.GetPrefixMeta("foo")
+	if !ok || meta != "rollup" {
+		t.Errorf("Expected rollup, got %q (%t)", meta, ok)
+	}
+
+	if _, ok := trie.Find("foo"); ok {
+		t.Error("Expected prefix meta not to make foo a key")
+	}
+	if keys := trie.Keys(); len(keys) != 1 || keys[0] != "foobar" {
+		t.Errorf("Expected [foobar], got %v", keys)
+	}
+
+	trie.Add("foo", "exact")
+	if n, _ := trie.Find("foo"); n.meta != "exact" {
+		t.Errorf("Expected key meta exact, got %q", n.meta)
+	}
+	if meta, _ := trie.GetPrefixMeta("foo"); meta != "rollup" {
+		t.Errorf("Expected prefix meta to be untouched by Add, got %q", meta)
+	}
+
+	trie.SetPrefixMeta("bar", "missing")
+	if _, ok := trie.GetPrefixMeta("bar"); ok {
+		t.Error("Expected SetPrefixMeta on an unknown prefix to be a no-op")
+	}
+}
+
+func TestSortedKeysDesc(t *testing.T) {
+	trie := New[interface{}]()
+	for _, key := range []string{"foo", "bar", "foobar", "baz", "a", "苹果"} {
+		trie.Add(key, nil)
+	}
+
+	expected := []string{"苹果", "foobar", "foo", "baz", "bar", "a"}
+	actual := trie.SortedKeysDesc()
+	if len(actual) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, actual)
+	}
+	for i := range expected {
+		if actual[i] != expected[i] {
+			t.Errorf("Expected %v, got %v", expected, actual)
+			break
+		}
+	}
+
+	if keys := New[interface{}]().SortedKeysDesc(); len(keys) != 0 {
+		t.Errorf("Expected no keys, got %v", keys)
+	}
+}
+
+func TestFuzzySearchHighlights(t *testing.T) {
+	trie := New[interface{}]()
+	for _, key := range []string{"football", "frosty", "bar", "苹果 沂水县"} {
+		trie.Add(key, nil)
+	}
+
+	tests := []struct {
+		partial  string
+		expected map[string][]int
+	}{
+		{"ft", map[string][]int{"football": {0, 3}, "frosty": {0, 4}}},
+		{"fbl", map[string][]int{"football": {0, 4, 6}}},
+		{"果水", map[string][]int{"苹果 沂水县": {1, 4}}},
+		{"", map[string][]int{"football": nil, "frosty": nil, "bar": nil, "苹果 沂水县": nil}},
+	}
+
+	for _, test := range tests {
+		matches := trie.FuzzySearchHighlights(test.partial)
+		if len(matches) != len(test.expected) {
+			t.Errorf("FuzzySearchHighlights(%q): expected %d matches, got %v", test.partial, len(test.expected), matches)
+			continue
+		}
+		for _, m := range matches {
+			expected, ok := test.expected[m.Key]
+			if !ok {
+				t.Errorf("FuzzySearchHighlights(%q): unexpected key %q", test.partial, m.Key)
+				continue
+			}
+			if len(m.Positions) != len(expected) {
+				t.Errorf("FuzzySearchHighlights(%q): expected %v for %q, got %v", test.partial, expected, m.Key, m.Positions)
+				continue
+			}
+			for i := range expected {
+				if m.Positions[i] != expected[i] {
+					t.Errorf("FuzzySearchHighlights(%q): expected %v for %q, got %v", test.partial, expected, m.Key, m.Positions)
+					break
+				}
+			}
+		}
+	}
+}
+
+func TestRecomputeMasks(t *testing.T) {
+	trie := New[interface{}]()
+	for _, key := range []string{"foosball", "football", "frosty"} {
+		trie.Add(key, nil)
+	}
+
+	// Simulate the corruption older versions of Remove left behind.
+	trie.root.mask = 0
+	findNode(trie.root, []rune("foo")).mask = maskruneslice([]rune("fo"))
+	if keys := trie.FuzzySearch("fs"); len(keys) == 2 {
+		t.Fatalf("Expected corrupted masks to hide matches, got %v", keys)
+	}
+
+	trie.RecomputeMasks()
+	if keys := trie.FuzzySearch("fs"); len(keys) != 2 {
+		t.Errorf("Expected 2 matches after RecomputeMasks, got %v", keys)
+	}
+	if keys := trie.FuzzySearch("y"); len(keys) != 1 || keys[0] != "frosty" {
+		t.Errorf("Expected [frosty], got %v", keys)
+	}
+	if expected := maskruneslice([]rune("fosbaltry")); trie.root.mask != expected {
+		t.Errorf("Expected root mask %b, got %b", expected, trie.root.mask)
+	}
+}
+
+func TestReplayWAL(t *testing.T) {
+	encode := func(v int) []byte { return []byte(strconv.Itoa(v)) }
+	decode := func(b []byte) int {
+		v, _ := strconv.Atoi(string(b))
+		return v
+	}
+
+	var log bytes.Buffer
+	trie := New[int]()
+	trie.EnableWAL(&log, encode)
+	trie.Add("foo", 1)
+	trie.Add("foobar", 2)
+	trie.Add("bar", 3)
+	trie.Remove("foo")
+	trie.Add("bar", 4)
+	trie.RemoveIf(func(key string, meta int) bool { return key == "foobar" })
+	trie.Add("baz", 5)
+	if err := trie.WALErr(); err != nil {
+		t.Fatal(err)
+	}
+
+	replayed := New[int]()
+	if err := replayed.ReplayWAL(&log, decode); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := trie.Keys()
+	actual := replayed.Keys()
+	sort.Strings(expected)
+	sort.Strings(actual)
+	if len(actual) != len(expected) {
+		t.Fatalf("Expected keys %v, got %v", expected, actual)
+	}
+	for i := range expected {
+		if actual[i] != expected[i] {
+			t.Errorf("Expected keys %v, got %v", expected, actual)
+		}
+	}
+	if n, ok := replayed.Find("bar"); !ok || n.meta != 4 {
+		t.Errorf("Expected bar to replay with meta 4, got %v", n)
+	}
+}
+
+func TestReplayWALCorrupt(t *testing.T) {
+	trie := New[int]()
+	err := trie.ReplayWAL(bytes.NewReader([]byte{'x', 0}), func([]byte) int { return 0 })
+	if err != errBadWALRecord {
+		t.Errorf("Expected errBadWALRecord, got %v", err)
+	}
+}
+
+func TestNearestK(t *testing.T) {
+	trie := New[interface{}]()
+	for _, key := range []string{"book", "back", "boon", "cook", "look", "bookkeeper", "zebra"} {
+		trie.Add(key, nil)
+	}
+
+	tests := []struct {
+		query    string
+		k        int
+		expected []string
+	}{
+		{"book", 1, []string{"book"}},
+		{"book", 4, []string{"book", "boon", "cook", "look"}},
+		{"bok", 3, []string{"book", "back", "boon"}},
+		{"zebra", 2, []string{"zebra", "back"}},
+		{"book", 100, []string{"book", "boon", "cook", "look", "back", "zebra", "bookkeeper"}},
+		{"book", 0, nil},
+	}
+
+	for _, test := range tests {
+		actual := trie.NearestK(test.query, test.k)
+		if len(actual) != len(test.expected) {
+			t.Errorf("NearestK(%q, %d): expected %v, got %v", test.query, test.k, test.expected, actual)
+			continue
+		}
+		for i := range actual {
+			if actual[i] != test.expected[i] {
+				t.Errorf("NearestK(%q, %d): expected %v, got %v", test.query, test.k, test.expected, actual)
+				break
+			}
+		}
+	}
+}
+
+func TestBranchingReport(t *testing.T) {
+	trie := New[interface{}]()
+	trie.Add("foo", nil)
+	trie.Add("fob", nil)
+
+	// root -> f -> o -> {o, b}, each of which ends a key.
+	expected := map[int]int{0: 2, 1: 4, 2: 1}
+	report := trie.BranchingReport()
+	if len(report) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, report)
+	}
+	for children, count := range expected {
+		if report[children] != count {
+			t.Errorf("Expected %v, got %v", expected, report)
+		}
+	}
+}
+
+func TestFuzzySearchNoDuplicates(t *testing.T) {
+	trie := New[interface{}]()
+	for _, key := range []string{"aaa", "aaaa", "abab", "a"} {
+		trie.Add(key, nil)
+	}
+
+	tests := []struct {
+		partial  string
+		expected []string
+	}{
+		{"aa", []string{"aaa", "aaaa", "abab"}},
+		{"aaa", []string{"aaa", "aaaa"}},
+		{"ab", []string{"abab"}},
+	}
+
+	for _, test := range tests {
+		actual := trie.FuzzySearch(test.partial)
+		if len(actual) != len(test.expected) {
+			t.Errorf("FuzzySearch(%q): expected %v, got %v", test.partial, test.expected, actual)
+			continue
+		}
+		for i := range actual {
+			if actual[i] != test.expected[i] {
+				t.Errorf("FuzzySearch(%q): expected %v, got %v", test.partial, test.expected, actual)
+				break
+			}
+		}
+	}
+}
+
+func TestFindAll(t *testing.T) {
+	trie := New[int]()
+	trie.Add("foo", 1)
+	trie.Add("foobar", 2)
+	trie.Add("bar", 3)
+
+	found := trie.FindAll([]string{"foo", "fo", "bar", "baz", "foobar", "foo"})
+	expected := map[string]int{"foo": 1, "foobar": 2, "bar": 3}
+	if len(found) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, found)
+	}
+	for key, meta := range expected {
+		if found[key] != meta {
+			t.Errorf("Expected %s to have meta %d, got %d", key, meta, found[key])
+		}
+	}
+}
+
+func TestPrefixSearchMaxDepth(t *testing.T) {
+	trie := New[interface{}]()
+	for _, key := range []string{"foo", "foob", "fooba", "foobar", "fox", "bar"} {
+		trie.Add(key, nil)
+	}
+
+	tests := []struct {
+		pre      string
+		maxDepth int
+		expected []string
+	}{
+		{"foo", 0, []string{"foo"}},
+		{"foo", 2, []string{"foo", "foob", "fooba"}},
+		{"fo", 1, []string{"foo", "fox"}},
+		{"", 3, []string{"bar", "foo", "fox"}},
+		{"foo", 10, []string{"foo", "foob", "fooba", "foobar"}},
+		{"foo", -1, nil},
+		{"zzz", 1, nil},
+	}
+
+	for _, test := range tests {
+		actual := trie.PrefixSearchMaxDepth(test.pre, test.maxDepth)
+		sort.Strings(actual)
+		if len(actual) != len(test.expected) {
+			t.Errorf("PrefixSearchMaxDepth(%q, %d): expected %v, got %v", test.pre, test.maxDepth, test.expected, actual)
+			continue
+		}
+		for i := range actual {
+			if actual[i] != test.expected[i] {
+				t.Errorf("PrefixSearchMaxDepth(%q, %d): expected %v, got %v", test.pre, test.maxDepth, test.expected, actual)
+				break
+			}
+		}
+	}
+}
+
+func TestCountingTrie(t *testing.T) {
+	counts := NewCounting()
+	for _, word := range []string{"the", "cat", "the", "hat", "the", "cat"} {
+		counts.Add(word)
+	}
+
+	for word, expected := range map[string]int{"the": 3, "cat": 2, "hat": 1, "dog": 0} {
+		if count := counts.Count(word); count != expected {
+			t.Errorf("Expected Count(%q) == %d, got %d", word, expected, count)
+		}
+	}
+
+	if remaining := counts.Remove("the"); remaining != 2 {
+		t.Errorf("Expected 2 remaining, got %d", remaining)
+	}
+	if remaining := counts.Remove("hat"); remaining != 0 {
+		t.Errorf("Expected 0 remaining, got %d", remaining)
+	}
+	if _, ok := counts.Find("hat"); ok {
+		t.Error("Expected hat to be removed once its count reached zero")
+	}
+	if remaining := counts.Remove("dog"); remaining != 0 {
+		t.Errorf("Expected 0 remaining for a missing key, got %d", remaining)
+	}
+
+	keys := counts.PrefixSearch("")
+	sort.Strings(keys)
+	if len(keys) != 2 || keys[0] != "cat" || keys[1] != "the" {
+		t.Errorf("Expected [cat the], got %v", keys)
+	}
+
+	// "cat" takes four nodes, leaving no room for "dog" but letting
+	// "cat" be counted again.
+	capped := NewCounting(WithMaxNodes[int](4))
+	if count := capped.Add("cat"); count != 1 {
+		t.Errorf("Expected a count of 1, got %d", count)
+	}
+	if count := capped.Add("dog"); count != 0 {
+		t.Errorf("Expected a count of 0 for a key that does not fit, got %d", count)
+	}
+	if count := capped.Add("cat"); count != 2 {
+		t.Errorf("Expected a count of 2, got %d", count)
+	}
+	if count := capped.Count("dog"); count != 0 {
+		t.Errorf("Expected dog not to be stored, got a count of %d", count)
+	}
+}
+
+func TestIsSubsetOf(t *testing.T) {
+	build := func(keys ...string) *Trie[interface{}] {
+		trie := New[interface{}]()
+		for _, key := range keys {
+			trie.Add(key, nil)
+		}
+		return trie
+	}
+
+	small := build("foo", "bar")
+	large := build("foo", "bar", "foobar")
+	equal := build("bar", "foo")
+	other := build("foo", "baz")
+	empty := build()
+
+	tests := []struct {
+		name     string
+		a, b     *Trie[interface{}]
+		expected bool
+	}{
+		{"Subset", small, large, true},
+		{"Superset", large, small, false},
+		{"Equal", small, equal, true},
+		{"Same", small, small, true},
+		{"Disjoint", small, other, false},
+		{"Empty", empty, small, true},
+		{"IntoEmpty", small, empty, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if actual := test.a.IsSubsetOf(test.b); actual != test.expected {
+				t.Errorf("Expected %t, got %t", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestPatternSearch(t *testing.T) {
+	trie := New[interface{}]()
+	for _, key := range []string{"foo", "goo", "hoo", "fooo", "fo", "f?o", "[oo", "苹果"} {
+		trie.Add(key, nil)
+	}
+
+	tests := []struct {
+		pat      string
+		expected []string
+	}{
+		{"[fg]oo", []string{"foo", "goo"}},
+		{"[f-h]oo", []string{"foo", "goo", "hoo"}},
+		{"[^f]oo", []string{"[oo", "goo", "hoo"}},
+		{"?oo", []string{"[oo", "foo", "goo", "hoo"}},
+		{"f\\?o", []string{"f?o"}},
+		{"[oo", []string{"[oo"}},
+		{"苹?", []string{"苹果"}},
+		{"fo", []string{"fo"}},
+		{"[xy]oo", nil},
+	}
+
+	for _, test := range tests {
+		actual := trie.PatternSearch(test.pat)
+		sort.Strings(actual)
+		if len(actual) != len(test.expected) {
+			t.Errorf("PatternSearch(%q): expected %v, got %v", test.pat, test.expected, actual)
+			continue
+		}
+		for i := range actual {
+			if actual[i] != test.expected[i] {
+				t.Errorf("PatternSearch(%q): expected %v, got %v", test.pat, test.expected, actual)
+				break
+			}
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	trie := New[interface{}]()
+	for _, key := range []string{"foo", "foobar", "bar", "baz"} {
+		trie.Add(key, nil)
+	}
+	trie.Add("foo", nil)
+	trie.Remove("baz")
+	trie.Remove("missing")
+	if err := trie.Validate(); err != nil {
+		t.Fatalf("Expected a valid trie, got %v", err)
+	}
+
+	// Recreate the drift duplicate adds used to cause.
+	trie.size++
+	if err := trie.Validate(); err == nil {
+		t.Error("Expected size drift to be reported")
+	}
+	trie.size--
+
+	findNode(trie.root, []rune("foo")).mask = 0
+	if err := trie.Validate(); err == nil {
+		t.Error("Expected an inconsistent mask to be reported")
+	}
+}
+
+func TestNodeMetaPtr(t *testing.T) {
+	type stats struct {
+		hits    int
+		samples [64]int
+	}
+
+	trie := New[stats]()
+	trie.Add("foo", stats{hits: 1})
+
+	n, _ := trie.Find("foo")
+	p := n.MetaPtr()
+	p.hits++
+	p.samples[63] = 7
+
+	n, _ = trie.Find("foo")
+	if meta := n.Meta(); meta.hits != 2 || meta.samples[63] != 7 {
+		t.Errorf("Expected updates through MetaPtr to stick, got hits=%d sample=%d", meta.hits, meta.samples[63])
+	}
+}
+
+func TestSuffixesOfPrefix(t *testing.T) {
+	trie := New[interface{}]()
+	for _, key := range []string{"foo/bart/baz.go", "foo/bar.go", "foo", "苹果 沂水县", "苹果"} {
+		trie.Add(key, nil)
+	}
+
+	tests := []struct {
+		pre      string
+		expected []string
+	}{
+		{"foo/", []string{"bar.go", "bart/baz.go"}},
+		{"foo", []string{"", "/bar.go", "/bart/baz.go"}},
+		{"苹果", []string{"", " 沂水县"}},
+		{"bar", nil},
+	}
+
+	for _, test := range tests {
+		actual := trie.SuffixesOfPrefix(test.pre)
+		sort.Strings(actual)
+		if len(actual) != len(test.expected) {
+			t.Errorf("SuffixesOfPrefix(%q): expected %q, got %q", test.pre, test.expected, actual)
+			continue
+		}
+		for i := range actual {
+			if actual[i] != test.expected[i] {
+				t.Errorf("SuffixesOfPrefix(%q): expected %q, got %q", test.pre, test.expected, actual)
+				break
+			}
+		}
+	}
+}
+
+// TestConcurrentReadersAndWriters is meant to be run with -race.
+func TestConcurrentReadersAndWriters(t *testing.T) {
+	trie := New[int]()
+	words := []string{"foo", "foobar", "foosball", "football", "bar", "baz", "苹果"}
+	for i, word := range words {
+		trie.Add(word, i)
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				key := words[(i+w)%len(words)] + strconv.Itoa(w)
+				trie.Add(key, i)
+				if i%3 == 0 {
+					trie.Remove(key)
+				}
+			}
+		}(w)
+	}
+	for r := 0; r < 8; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				word := words[(i+r)%len(words)]
+				if n, ok := trie.Find(word); !ok || n.Meta() < 0 {
+					t.Errorf("Expected to find %s", word)
+					return
+				}
+				trie.PrefixSearch("foo")
+				trie.FuzzySearch("fb")
+			}
+		}(r)
+	}
+	wg.Wait()
+
+	if err := trie.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLockFreeReads(t *testing.T) {
+	trie := New(WithLockFreeReads[int]())
+	trie.Add("foo", 1)
+	trie.Add("bar", 2)
+
+	// Find and PrefixSearch must not wait for a writer.
+	trie.mu.Lock()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if n, ok := trie.Find("foo"); !ok || n.Meta() != 1 {
+			t.Errorf("Expected to find foo with 1, got %v, %v", n, ok)
+		}
+		if keys := trie.PrefixSearch("f"); len(keys) != 1 || keys[0] != "foo" {
+			t.Errorf("Expected [foo], got %v", keys)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected Find and PrefixSearch to skip the lock")
+	}
+	trie.mu.Unlock()
+
+	// A node handed out earlier is a snapshot that writes replace.
+	n, _ := trie.Find("foo")
+	trie.UpdateMetas(map[string]int{"foo": 3})
+	trie.Add("food", 4)
+	if n.Meta() != 1 {
+		t.Errorf("Expected the earlier node to keep 1, got %d", n.Meta())
+	}
+	if m, ok := trie.Find("foo"); !ok || m.Meta() != 3 {
+		t.Errorf("Expected to find foo with 3, got %v, %v", m, ok)
+	}
+	if problems := trie.CheckInvariants(); len(problems) != 0 {
+		t.Errorf("Expected no problems, got %v", problems)
+	}
+}
+
+func TestLockFreeReadsSeeWholeWrites(t *testing.T) {
+	trie := New(WithLockFreeReads[int]())
+	trie.Add("tagged", -1)
+	trie.AddTag("tagged", "t")
+	const (
+		count   = 500
+		readers = 4
+	)
+	key := func(i int) string { return fmt.Sprintf("k%04d", i) }
+
+	// The writer waits for every reader to be running, and everyone
+	// yields between calls, so that walks and writes interleave even on
+	// a single CPU.
+	var wg, ready sync.WaitGroup
+	ready.Add(readers)
+	written := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(written)
+		ready.Wait()
+		for i := 0; i < count; i++ {
+			runtime.Gosched()
+			trie.Add(key(i), i)
+			runtime.Gosched()
+			switch i % 5 {
+			case 0:
+				trie.Each(func(_ string, meta *int) {})
+			case 1:
+				trie.SoftDelete("tagged")
+				runtime.Gosched()
+				trie.Resurrect("tagged")
+			case 2:
+				trie.UpdateMetas(map[string]int{"tagged": i})
+			case 3:
+				trie.Add("x", i)
+				runtime.Gosched()
+				trie.Remove("x")
+			case 4:
+				trie.ShrinkToFit()
+			}
+		}
+	}()
+	for r := 0; r < readers; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ready.Done()
+			seen := 0
+			for last := false; !last; {
+				select {
+				case <-written:
+					last = true
+				default:
+					runtime.Gosched()
+				}
+				// Keys are added in order, so every version of the
+				// trie holds the first few of them and no others.
+				keys := trie.PrefixSearch("k")
+				if len(keys) < seen {
+					t.Errorf("Expected at least %d keys, got %d", seen, len(keys))
+					return
+				}
+				seen = len(keys)
+				sort.Strings(keys)
+				for i, k := range keys {
+					if k != key(i) {
+						t.Errorf("Expected %s at %d, got %s", key(i), i, k)
+						return
+					}
+				}
+				if seen > 0 {
+					if n, ok := trie.Find(key(seen - 1)); !ok || n.Meta() != seen-1 {
+						t.Errorf("Expected to find %s with %d, got %v, %v", key(seen-1), seen-1, n, ok)
+						return
+					}
+				}
+				// Also walk the keys the writer keeps changing.
+				if n, ok := trie.Find("tagged"); ok {
+					n.Meta()
+				}
+				trie.PrefixSearch("x")
+			}
+		}()
+	}
+	wg.Wait()
+
+	if keys := trie.PrefixSearch("k"); len(keys) != count {
+		t.Errorf("Expected %d keys, got %d", count, len(keys))
+	}
+	if problems := trie.CheckInvariants(); len(problems) != 0 {
+		t.Errorf("Expected no problems, got %v", problems)
+	}
+	// Tags follow their keys into the copies writes make.
+	if keys := trie.KeysWithTag("t"); len(keys) != 1 || keys[0] != "tagged" {
+		t.Errorf("Expected [tagged], got %v", keys)
+	}
+	trie.Remove("tagged")
+	if keys := trie.KeysWithTag("t"); len(keys) != 0 {
+		t.Errorf("Expected the tag to go with its key, got %v", keys)
+	}
+}
+
+func TestFuzzyPrefixSearch(t *testing.T) {
+	trie := New[interface{}]()
+	for _, key := range []string{"foo", "foosball", "football", "fob", "bar", "boo"} {
+		trie.Add(key, nil)
+	}
+
+	tests := []struct {
+		pre      string
+		maxDist  int
+		expected []string
+	}{
+		{"fo0", 1, []string{"fob", "foo", "foosball", "football"}},
+		{"fo0", 0, nil},
+		{"foot", 0, []string{"football"}},
+		{"fooy", 1, []string{"foo", "foosball", "football"}},
+		{"xx", 2, []string{"bar", "boo", "fob", "foo", "foosball", "football"}},
+	}
+
+	for _, test := range tests {
+		actual := trie.FuzzyPrefixSearch(test.pre, test.maxDist)
+		sort.Strings(actual)
+		if len(actual) != len(test.expected) {
+			t.Errorf("FuzzyPrefixSearch(%q, %d): expected %v, got %v", test.pre, test.maxDist, test.expected, actual)
+			continue
+		}
+		for i := range actual {
+			if actual[i] != test.expected[i] {
+				t.Errorf("FuzzyPrefixSearch(%q, %d): expected %v, got %v", test.pre, test.maxDist, test.expected, actual)
+				break
+			}
+		}
+	}
+}
+
+func TestNewWithCapacity(t *testing.T) {
+	trie := NewWithCapacity[int](10)
+	for i, key := range []string{"foo", "bar", "baz"} {
+		trie.Add(key, i)
+	}
+	if keys := trie.Keys(); len(keys) != 3 {
+		t.Errorf("Expected 3 keys, got %v", keys)
+	}
+
+	// The hint is advisory, so nonsense values must still work.
+	trie = NewWithCapacity[int](-1)
+	trie.Add("foo", 1)
+	if _, ok := trie.Find("foo"); !ok {
+		t.Error("Expected to find foo")
+	}
+}
+
+func TestAlphabet(t *testing.T) {
+	trie := New[interface{}]()
+	for _, key := range []string{"bad", "cab", "苹果", "Zoë"} {
+		trie.Add(key, nil)
+	}
+
+	expected := []rune{'Z', 'a', 'b', 'c', 'd', 'o', 'ë', '果', '苹'}
+	actual := trie.Alphabet()
+	if string(actual) != string(expected) {
+		t.Errorf("Expected %q, got %q", string(expected), string(actual))
+	}
+
+	if alphabet := New[interface{}]().Alphabet(); len(alphabet) != 0 {
+		t.Errorf("Expected an empty alphabet, got %q", string(alphabet))
+	}
+}
+
+// germanCollator is a stand-in for a collate.Collator: it orders words
+// as if umlauts were their base letters, falling back to byte order.
+type germanCollator struct{}
+
+func (germanCollator) CompareString(a, b string) int {
+	fold := func(s string) string {
+		rs := []rune(s)
+		for i, r := range rs {
+			rs[i] = foldDiacritic(r)
+		}
+		return string(rs)
+	}
+	if c := strings.Compare(fold(a), fold(b)); c != 0 {
+		return c
+	}
+	return strings.Compare(a, b)
+}
+
+// exclusiveCollator orders keys by byte order and reports an error if
+// it is ever called from two goroutines at once.
+type exclusiveCollator struct {
+	t      *testing.T
+	active atomic.Int32
+}
+
+func (c *exclusiveCollator) CompareString(a, b string) int {
+	if c.active.Add(1) != 1 {
+		c.t.Error("Expected calls to the collator to be serialized")
+	}
+	runtime.Gosched()
+	c.active.Add(-1)
+	return strings.Compare(a, b)
+}
+
+// sortConcurrently calls Keys on every trie from a goroutine of its own.
+func sortConcurrently[T any](tries ...*Trie[T]) {
+	var wg sync.WaitGroup
+	for _, trie := range tries {
+		wg.Add(1)
+		go func(trie *Trie[T]) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				trie.Keys()
+			}
+		}(trie)
+	}
+	wg.Wait()
+}
+
+func TestCollator(t *testing.T) {
+	trie := New[interface{}](WithCollator[interface{}](germanCollator{}))
+	for _, key := range []string{"Zebra", "Äpfel", "Bär", "Apfel", "Bahn", "Öl"} {
+		trie.Add(key, nil)
+	}
+
+	expected := []string{"Apfel", "Äpfel", "Bahn", "Bär", "Öl", "Zebra"}
+	keys := trie.Keys()
+	if strings.Join(keys, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected Keys %v, got %v", expected, keys)
+	}
+
+	expected = []string{"Bahn", "Bär"}
+	if keys := trie.PrefixSearch("B"); strings.Join(keys, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected PrefixSearch %v, got %v", expected, keys)
+	}
+
+	// FuzzySearch still ranks by length and only breaks ties by
+	// collation; "Äb" and "Acc" are both three bytes long.
+	fuzzy := New[interface{}](WithCollator[interface{}](germanCollator{}))
+	for _, key := range []string{"Acc", "Äb", "ABCD"} {
+		fuzzy.Add(key, nil)
+	}
+	expected = []string{"Äb", "Acc", "ABCD"}
+	if keys := fuzzy.FuzzySearch(""); strings.Join(keys, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected FuzzySearch %v, got %v", expected, keys)
+	}
+}
+
+func TestNextPrev(t *testing.T) {
+	trie := New[interface{}]()
+	sorted := []string{"a", "ab", "abc", "abd", "b", "ba", "苹果"}
+	for _, key := range sorted {
+		trie.Add(key, nil)
+	}
+
+	for i, key := range sorted {
+		next, ok := trie.Next(key)
+		if i == len(sorted)-1 {
+			if ok {
+				t.Errorf("Expected no key after %q, got %q", key, next)
+			}
+		} else if !ok || next != sorted[i+1] {
+			t.Errorf("Next(%q): expected %q, got %q (%t)", key, sorted[i+1], next, ok)
+		}
+
+		prev, ok := trie.Prev(key)
+		if i == 0 {
+			if ok {
+				t.Errorf("Expected no key before %q, got %q", key, prev)
+			}
+		} else if !ok || prev != sorted[i-1] {
+			t.Errorf("Prev(%q): expected %q, got %q (%t)", key, sorted[i-1], prev, ok)
+		}
+	}
+
+	tests := []struct {
+		key, next, prev string
+	}{
+		{"", "a", ""},
+		{"aa", "ab", "a"},
+		{"abca", "abd", "abc"},
+		{"abz", "b", "abd"},
+		{"c", "苹果", "ba"},
+		{"zzz", "苹果", "ba"},
+	}
+	for _, test := range tests {
+		if next, _ := trie.Next(test.key); next != test.next {
+			t.Errorf("Next(%q): expected %q, got %q", test.key, test.next, next)
+		}
+		if prev, _ := trie.Prev(test.key); prev != test.prev {
+			t.Errorf("Prev(%q): expected %q, got %q", test.key, test.prev, prev)
+		}
+	}
+}
+
+func TestFuzzyWalk(t *testing.T) {
+	trie := New[int]()
+	for i, key := range []string{"foosball", "football", "frosty", "bar"} {
+		trie.Add(key, i)
+	}
+
+	var visited []string
+	trie.FuzzyWalk("ft", func(key string, meta int) bool {
+		visited = append(visited, key)
+		return true
+	})
+	sort.Strings(visited)
+	if strings.Join(visited, ",") != "football,frosty" {
+		t.Errorf("Expected [football frosty], got %v", visited)
+	}
+
+	calls := 0
+	trie.FuzzyWalk("f", func(key string, meta int) bool {
+		calls++
+		return false
+	})
+	if calls != 1 {
+		t.Errorf("Expected the walk to stop after one match, got %d calls", calls)
+	}
+}
+
+func TestNodePaths(t *testing.T) {
+	trie := New[interface{}](WithNodePaths[interface{}]())
+	trie.Add("foobar", nil)
+	trie.Add("苹果", nil)
+
+	for _, pre := range []string{"f", "foo", "foobar", "苹"} {
+		if path := findNode(trie.root, []rune(pre)).Path(); path != pre {
+			t.Errorf("Expected intermediate node to report %q, got %q", pre, path)
+		}
+	}
+	if n, _ := trie.Find("foobar"); n.Path() != "foobar" {
+		t.Errorf("Expected key node to report foobar, got %q", n.Path())
+	}
+	if keys := trie.PrefixSearch("foo"); len(keys) != 1 || keys[0] != "foobar" {
+		t.Errorf("Expected intermediate paths not to show up as keys, got %v", keys)
+	}
+
+	plain := New[interface{}]()
+	plain.Add("foobar", nil)
+	if path := findNode(plain.root, []rune("foo")).Path(); path != "" {
+		t.Errorf("Expected no intermediate path by default, got %q", path)
+	}
+}
+
+func TestFuzzyCount(t *testing.T) {
+	trie := New[interface{}]()
+	for _, key := range []string{"foosball", "football", "bmerica", "ked", "kedlock", "frosty", "bfrza", "foo/bart/baz.go"} {
+		trie.Add(key, nil)
+	}
+	trie.Add("football", nil)
+	trie.Remove("bmerica")
+
+	for _, partial := range []string{"fsb", "footbal", "fs", "ft", "a", "", "zzz", "k"} {
+		if count, expected := trie.FuzzyCount(partial), len(trie.FuzzySearch(partial)); count != expected {
+			t.Errorf("FuzzyCount(%q): expected %d, got %d", partial, expected, count)
+		}
+	}
+}
+
+func TestEditSearch(t *testing.T) {
+	trie := New[interface{}]()
+	for _, key := range []string{"cat", "cut", "cute", "cart", "dog"} {
+		trie.Add(key, nil)
+	}
+
+	tests := []struct {
+		query    string
+		maxDist  int
+		expected []string
+	}{
+		{"cat", 0, []string{"cat"}},
+		{"cat", 1, []string{"cat", "cart", "cut"}},
+		{"cat", 2, []string{"cat", "cart", "cut", "cute"}},
+		{"xyz", 1, []string{}},
+	}
+	for _, test := range tests {
+		actual := trie.EditSearch(test.query, test.maxDist)
+		if strings.Join(actual, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("EditSearch(%q, %d): expected %v, got %v", test.query, test.maxDist, test.expected, actual)
+		}
+	}
+}
+
+func TestEditSearchRelative(t *testing.T) {
+	trie := New[interface{}]()
+	for _, key := range []string{"cat", "cut", "cute", "international", "internasional", "intrnatonal"} {
+		trie.Add(key, nil)
+	}
+
+	tests := []struct {
+		query    string
+		ratio    float64
+		expected []string
+	}{
+		// ceil(0.2 * 3) allows a single edit on a short word...
+		{"cat", 0.2, []string{"cat", "cut"}},
+		// ...while ceil(0.2 * 13) allows three on a long one.
+		{"international", 0.2, []string{"international", "internasional", "intrnatonal"}},
+		// Small ratios still allow one edit.
+		{"international", 0.01, []string{"international", "internasional"}},
+	}
+	for _, test := range tests {
+		actual := trie.EditSearchRelative(test.query, test.ratio)
+		if strings.Join(actual, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("EditSearchRelative(%q, %v): expected %v, got %v", test.query, test.ratio, test.expected, actual)
+		}
+	}
+}
+
+func TestHottestPrefixes(t *testing.T) {
+	trie := New[interface{}]()
+	for _, key := range []string{"foo", "foobar", "football", "fab", "bar", "baz", "cat"} {
+		trie.Add(key, nil)
+	}
+
+	tests := []struct {
+		depth, k int
+		expected []PrefixCount
+	}{
+		{1, 2, []PrefixCount{{"f", 4}, {"b", 2}}},
+		{2, 10, []PrefixCount{{"fo", 3}, {"ba", 2}, {"ca", 1}, {"fa", 1}}},
+		{4, 10, []PrefixCount{{"foob", 1}, {"foot", 1}}},
+		{0, 1, []PrefixCount{{"", 7}}},
+		{1, 0, []PrefixCount{}},
+	}
+
+	for _, test := range tests {
+		actual := trie.HottestPrefixes(test.depth, test.k)
+		if len(actual) != len(test.expected) {
+			t.Errorf("HottestPrefixes(%d, %d): expected %v, got %v", test.depth, test.k, test.expected, actual)
+			continue
+		}
+		for i := range actual {
+			if actual[i] != test.expected[i] {
+				t.Errorf("HottestPrefixes(%d, %d): expected %v, got %v", test.depth, test.k, test.expected, actual)
+				break
+			}
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	build := func(keys ...string) *Trie[interface{}] {
+		trie := New[interface{}]()
+		for _, key := range keys {
+			trie.Add(key, nil)
+		}
+		return trie
+	}
+
+	tests := []struct {
+		name           string
+		old, cur       *Trie[interface{}]
+		added, removed []string
+	}{
+		{"AddedOnly", build("foo"), build("foo", "foobar", "bar"), []string{"bar", "foobar"}, []string{}},
+		{"RemovedOnly", build("foo", "foobar", "bar"), build("foobar"), []string{}, []string{"bar", "foo"}},
+		{"Mixed", build("foo", "bar"), build("bar", "baz"), []string{"baz"}, []string{"foo"}},
+		{"Equal", build("foo"), build("foo"), []string{}, []string{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			added, removed := test.old.Diff(test.cur)
+			if strings.Join(added, ",") != strings.Join(test.added, ",") {
+				t.Errorf("Expected added %v, got %v", test.added, added)
+			}
+			if strings.Join(removed, ",") != strings.Join(test.removed, ",") {
+				t.Errorf("Expected removed %v, got %v", test.removed, removed)
+			}
+		})
+	}
+}
+
+func TestFindVeryLongKey(t *testing.T) {
+	long := strings.Repeat("a", 100000)
+	trie := New[int]()
+	trie.Add(long, 1)
+
+	if n, ok := trie.Find(long); !ok || n.meta != 1 {
+		t.Error("Expected to find the long key")
+	}
+	if _, ok := trie.Find(long[:len(long)-1]); ok {
+		t.Error("Expected a strict prefix of the long key not to be found")
+	}
+	if _, ok := trie.Find(long + "b"); ok {
+		t.Error("Expected an extension of the long key not to be found")
+	}
+	if !trie.HasKeysWithPrefix(long[:50000]) {
+		t.Error("Expected the long key to have a prefix of half its length")
+	}
+}
+
+func TestPrefixSearchJoined(t *testing.T) {
+	trie := New[interface{}]()
+	for _, key := range []string{"foo", "foobar", "football", "bar"} {
+		trie.Add(key, nil)
+	}
+
+	joined := trie.PrefixSearchJoined("foo", "\n")
+	keys := strings.Split(joined, "\n")
+	sort.Strings(keys)
+	if strings.Join(keys, ",") != "foo,foobar,football" {
+		t.Errorf("Expected foo, foobar and football, got %q", joined)
+	}
+
+	if joined := trie.PrefixSearchJoined("bar", ", "); joined != "bar" {
+		t.Errorf("Expected \"bar\", got %q", joined)
+	}
+	if joined := trie.PrefixSearchJoined("baz", ", "); joined != "" {
+		t.Errorf("Expected an empty string, got %q", joined)
+	}
+
+	collated := New[interface{}](WithCollator[interface{}](germanCollator{}))
+	for _, key := range []string{"Bär", "Bahn", "Baum"} {
+		collated.Add(key, nil)
+	}
+	if joined := collated.PrefixSearchJoined("B", ","); joined != "Bahn,Bär,Baum" {
+		t.Errorf("Expected \"Bahn,Bär,Baum\", got %q", joined)
+	}
+}
+
+func TestMissCache(t *testing.T) {
+	trie := New[int](WithMissCache[int](2))
+	trie.Add("foo", 1)
+
+	if _, ok := trie.Find("bar"); ok {
+		t.Fatal("Expected bar to be missing")
+	}
+	if !trie.misses.contains("bar") {
+		t.Fatal("Expected the miss to be cached")
+	}
+
+	trie.Add("bar", 2)
+	if n, ok := trie.Find("bar"); !ok || n.meta != 2 {
+		t.Errorf("Expected the cached miss to become a hit after Add, got %v", n)
+	}
+
+	trie.Find("a")
+	trie.Find("b")
+	trie.Find("c")
+	if trie.misses.contains("a") {
+		t.Error("Expected the least recently used miss to be evicted")
+	}
+	if !trie.misses.contains("b") || !trie.misses.contains("c") {
+		t.Error("Expected the two most recent misses to be cached")
+	}
+
+	if New[int]().misses != nil {
+		t.Error("Expected the miss cache to be off by default")
+	}
+}
+
+func TestKeysInRange(t *testing.T) {
+	trie := New[interface{}]()
+	words := []string{"apple", "banana", "mango", "nectarine", "zucchini", "Zebra", ""}
+	for _, word := range words {
+		trie.Add(word, nil)
+	}
+
+	first := trie.KeysInRange('a', 'm')
+	second := trie.KeysInRange('n', 'z')
+	sort.Strings(first)
+	sort.Strings(second)
+	if strings.Join(first, ",") != "apple,banana,mango" {
+		t.Errorf("Expected [apple banana mango], got %v", first)
+	}
+	if strings.Join(second, ",") != "nectarine,zucchini" {
+		t.Errorf("Expected [nectarine zucchini], got %v", second)
+	}
+
+	if keys := trie.KeysInRange('z', 'a'); len(keys) != 0 {
+		t.Errorf("Expected an empty range to match nothing, got %v", keys)
+	}
+}
+
+func TestTags(t *testing.T) {
+	trie := New[interface{}]()
+	for _, key := range []string{"foo", "foobar", "bar", "baz"} {
+		trie.Add(key, nil)
+	}
+
+	for _, key := range []string{"foo", "bar"} {
+		if !trie.AddTag(key, "short") {
+			t.Errorf("Expected to tag %s", key)
+		}
+	}
+	trie.AddTag("foobar", "long")
+	trie.AddTag("foo", "short")
+	if trie.AddTag("missing", "short") {
+		t.Error("Expected tagging a missing key to fail")
+	}
+
+	keys := trie.KeysWithTag("short")
+	sort.Strings(keys)
+	if strings.Join(keys, ",") != "bar,foo" {
+		t.Errorf("Expected [bar foo], got %v", keys)
+	}
+
+	trie.Add("foo", "updated")
+	trie.Remove("bar")
+	if keys := trie.KeysWithTag("short"); len(keys) != 1 || keys[0] != "foo" {
+		t.Errorf("Expected [foo] after removing bar, got %v", keys)
+	}
+	if keys := trie.KeysWithTag("none"); len(keys) != 0 {
+		t.Errorf("Expected no keys for an unknown tag, got %v", keys)
+	}
+
+	trie.Remove("foo")
+	if _, ok := trie.tags["short"]; ok {
+		t.Error("Expected the emptied tag to be dropped from the index")
+	}
+}
+
+func TestBuildParallel(t *testing.T) {
+	keys := []string{"foo", "foobar", "bar", "baz", "苹果", "", "foo", "zebra", "apple"}
+	metas := []int{1, 2, 3, 4, 5, 6, 7, 8, 9}
+
+	for _, shards := range []int{0, 1, 3, 16} {
+		trie := BuildParallel(keys, metas, shards)
+		if err := trie.Validate(); err != nil {
+			t.Errorf("shards=%d: %v", shards, err)
+		}
+		if trie.size != 8 {
+			t.Errorf("shards=%d: expected 8 keys, got %d", shards, trie.size)
+		}
+		if n, ok := trie.Find("foo"); !ok || n.meta != 7 {
+			t.Errorf("shards=%d: expected the last foo to win, got %v", shards, n)
+		}
+		if keys := trie.FuzzySearch("br"); len(keys) != 3 {
+			t.Errorf("shards=%d: expected masks to survive stitching, got %v", shards, keys)
+		}
+		for _, key := range keys {
+			if n, ok := trie.Find(key); !ok || n.parent == nil {
+				t.Errorf("shards=%d: expected to find %q", shards, key)
+			}
+		}
+	}
+}
+
+func BenchmarkBuildParallel(b *testing.B) {
+	words := createTrieAndAddFromFile[interface{}]("/usr/share/dict/words", nil).Keys()
+	metas := make([]interface{}, len(words))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		BuildParallel(words, metas, runtime.GOMAXPROCS(0))
+	}
+}
+
+func BenchmarkBuildSerial(b *testing.B) {
+	words := createTrieAndAddFromFile[interface{}]("/usr/share/dict/words", nil).Keys()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		trie := New[interface{}]()
+		for _, word := range words {
+			trie.Add(word, nil)
+		}
+	}
+}
+
+func TestLongestKey(t *testing.T) {
+	trie := New[interface{}]()
+	if _, ok := trie.LongestKey(); ok {
+		t.Error("Expected no longest key in an empty trie")
+	}
+
+	for _, key := range []string{"a", "foobar", "苹果苹果苹果", "abc", "zzzzzz", "foobaz"} {
+		trie.Add(key, nil)
+	}
+	if key, ok := trie.LongestKey(); !ok || key != "foobar" {
+		t.Errorf("Expected foobar, got %q (%t)", key, ok)
+	}
+
+	trie.Add("foobarbaz", nil)
+	if key, _ := trie.LongestKey(); key != "foobarbaz" {
+		t.Errorf("Expected foobarbaz, got %q", key)
+	}
+}
+
+// BenchmarkFindDenseNode measures scattered lookups below a root with
+// thousands of children.
+func BenchmarkFindDenseNode(b *testing.B) {
+	trie := New[interface{}]()
+	var keys []string
+	for i := 0; i < 4096; i++ {
+		key := string(rune(0x4e00+i)) + "果"
+		keys = append(keys, key)
+		trie.Add(key, nil)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		trie.Find(keys[i*7919%len(keys)])
+	}
+}
+
+func TestAppendKeys(t *testing.T) {
+	trie := New[interface{}]()
+	for _, key := range []string{"foo", "bar", "baz"} {
+		trie.Add(key, nil)
+	}
+
+	buf := make([]string, 1, 8)
+	buf[0] = "existing"
+	out := trie.AppendKeys(buf)
+	if len(out) != 4 || out[0] != "existing" {
+		t.Fatalf("Expected existing followed by 3 keys, got %v", out)
+	}
+	if &out[0] != &buf[0] {
+		t.Error("Expected AppendKeys to reuse the spare capacity of dst")
+	}
+
+	rest := out[1:]
+	sort.Strings(rest)
+	if strings.Join(rest, ",") != "bar,baz,foo" {
+		t.Errorf("Expected [bar baz foo], got %v", rest)
+	}
+
+	if out := New[interface{}]().AppendKeys(nil); len(out) != 0 {
+		t.Errorf("Expected nothing appended from an empty trie, got %v", out)
+	}
+}
+
+func TestConcurrentAddRemoveSameKeys(t *testing.T) {
+	trie := New[int]()
+	keys := []string{"a", "ab", "abc", "abd", "b", "ba", "", "abcdef"}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				key := keys[(i*(w+1))%len(keys)]
+				if (i+w)%2 == 0 {
+					trie.Add(key, w)
+				} else {
+					trie.Remove(key)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if err := trie.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if trie.size < 0 || trie.size != len(trie.Keys()) {
+		t.Errorf("Expected size %d to match %d stored keys", trie.size, len(trie.Keys()))
+	}
+	if trie.root.termCount != trie.size {
+		t.Errorf("Expected root termCount %d to match size %d", trie.root.termCount, trie.size)
+	}
+
+	// Every remaining node must still lead to a key and point back at
+	// its parent.
+	nodes := []*node[int]{trie.root}
+	for len(nodes) > 0 {
+		n := nodes[len(nodes)-1]
+		nodes = nodes[:len(nodes)-1]
+		if !n.term && n.termCount == 0 && n != trie.root {
+			t.Errorf("Found an orphaned subtree at depth %d (%q)", n.depth, n.val)
+		}
+		for _, c := range n.appendChildren(nil) {
+			if c.parent != n {
+				t.Errorf("Found a child of %q with a stale parent pointer", n.val)
+			}
+			nodes = append(nodes, c)
+		}
+	}
+
+	for _, key := range keys {
+		trie.Remove(key)
+	}
+	if err := trie.Validate(); err != nil {
+		t.Error(err)
+	}
+	if trie.root.numChildren() != 0 || trie.root.mask != 0 || trie.size != 0 {
+		t.Errorf("Expected an empty root, got %d children, mask %b, size %d",
+			trie.root.numChildren(), trie.root.mask, trie.size)
+	}
+}
+
+func TestPrefixSearchIncludesPrefixKey(t *testing.T) {
+	trie := New[interface{}]()
+	trie.Add("foo", nil)
+	trie.Add("foobar", nil)
+
+	keys := trie.PrefixSearch("foo")
+	sort.Strings(keys)
+	if strings.Join(keys, ",") != "foo,foobar" {
+		t.Errorf("Expected [foo foobar], got %v", keys)
+	}
+
+	// The prefix's own key must not depend on it having descendants, nor
+	// be reported once it is removed.
+	trie.Remove("foobar")
+	if keys := trie.PrefixSearch("foo"); len(keys) != 1 || keys[0] != "foo" {
+		t.Errorf("Expected [foo], got %v", keys)
+	}
+	trie.Add("foobar", nil)
+	trie.Remove("foo")
+	if keys := trie.PrefixSearch("foo"); len(keys) != 1 || keys[0] != "foobar" {
+		t.Errorf("Expected [foobar], got %v", keys)
+	}
+}
+
+func TestFuzzySearchAtLeast(t *testing.T) {
+	trie := New[interface{}]()
+	for _, key := range []string{"football", "foosball", "frosty", "bfrza", "kedlock"} {
+		trie.Add(key, nil)
+	}
+
+	tests := []struct {
+		partial  string
+		atLeast  int
+		expected []string
+	}{
+		// Enough exact matches: nothing is relaxed.
+		{"fb", 1, []string{"foosball", "football"}},
+		// "fx" has no exact match; one edit finds every key with an f.
+		{"fx", 1, []string{"bfrza", "frosty", "foosball", "football"}},
+		// Dropping the x of "fotx" finds "frosty" and "football"...
+		{"fotx", 1, []string{"frosty", "football"}},
+		// ...and "foosball" also needs the t substituted.
+		{"fotx", 4, []string{"frosty", "football", "foosball"}},
+		{"fotx", 0, []string{}},
+	}
+
+	for _, test := range tests {
+		actual := trie.FuzzySearchAtLeast(test.partial, test.atLeast)
+		if strings.Join(actual, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("FuzzySearchAtLeast(%q, %d): expected %v, got %v", test.partial, test.atLeast, test.expected, actual)
+		}
+	}
+}
+
+func TestFreeze(t *testing.T) {
+	trie := New[int]()
+	for i, key := range []string{"foo", "foobar", "bar", "baz"} {
+		trie.Add(key, i)
+	}
+	trie.Remove("baz")
+	trie.Freeze()
+	trie.Freeze()
+
+	if !trie.Frozen() {
+		t.Fatal("Expected trie to be frozen")
+	}
+	if n, ok := trie.Find("foobar"); !ok || n.Meta() != 1 {
+		t.Errorf("Expected to find foobar with meta 1")
+	}
+	if keys := trie.PrefixSearch("foo"); len(keys) != 2 {
+		t.Errorf("Expected 2 keys with prefix foo, got %v", keys)
+	}
+	if err := trie.Validate(); err != nil {
+		t.Errorf("Expected frozen trie to validate, got %v", err)
+	}
+
+	mutations := map[string]func(){
+		"Add":      func() { trie.Add("qux", 0) },
+		"Remove":   func() { trie.Remove("foo") },
+		"RemoveIf": func() { trie.RemoveIf(func(string, int) bool { return true }) },
+	}
+	for name, mutate := range mutations {
+		func() {
+			defer func() {
+				if r := recover(); r != ErrFrozen {
+					t.Errorf("%s: expected panic with ErrFrozen, got %v", name, r)
+				}
+			}()
+			mutate()
+		}()
+	}
+	if n := len(trie.Keys()); n != 3 {
+		t.Errorf("Expected 3 keys after failed mutations, got %d", n)
+	}
+}
+
+func benchmarkFind(b *testing.B, freeze bool) {
+	trie := createTrieAndAddFromFile[interface{}]("/usr/share/dict/words", nil)
+	if freeze {
+		trie.Freeze()
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		trie.Find("football")
+	}
+}
+
+func BenchmarkFindUnfrozen(b *testing.B) { benchmarkFind(b, false) }
+func BenchmarkFindFrozen(b *testing.B)   { benchmarkFind(b, true) }
+
+// benchmarkFindWhileWriting measures parallel lookups while another
+// goroutine keeps re-adding keys.
+func benchmarkFindWhileWriting(b *testing.B, opts ...Option[interface{}]) {
+	words := createTrieAndAddFromFile[interface{}]("/usr/share/dict/words", nil).Keys()
+	trie := New(opts...)
+	for _, word := range words {
+		trie.Add(word, nil)
+	}
+
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			trie.Add(words[i%len(words)], nil)
+		}
+	}()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			trie.Find(words[i%len(words)])
+		}
+	})
+	b.StopTimer()
+	close(stop)
+	<-stopped
+}
+
+func BenchmarkFindWhileWriting(b *testing.B) { benchmarkFindWhileWriting(b) }
+func BenchmarkFindWhileWritingLockFree(b *testing.B) {
+	benchmarkFindWhileWriting(b, WithLockFreeReads[interface{}]())
+}
+
+func benchmarkPrefixSearch(b *testing.B, freeze bool) {
+	trie := createTrieAndAddFromFile[interface{}]("/usr/share/dict/words", nil)
+	if freeze {
+		trie.Freeze()
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = trie.PrefixSearch("fo")
+	}
+}
+
+func BenchmarkPrefixSearchUnfrozen(b *testing.B) { benchmarkPrefixSearch(b, false) }
+func BenchmarkPrefixSearchFrozen(b *testing.B)   { benchmarkPrefixSearch(b, true) }
+
+func TestMergedSortedCompletions(t *testing.T) {
+	trie := New[interface{}]()
+	for _, key := range []string{"foo", "foobar", "football", "bar", "barcelona", "bark", "baz", "zum"} {
+		trie.Add(key, nil)
+	}
+
+	// "foo" and "foot" overlap, so football must only appear once.
+	actual := trie.MergedSortedCompletions([]string{"foo", "bar", "foot", "nope"})
+	expected := []string{"bar", "barcelona", "bark", "foo", "foobar", "football"}
+	if strings.Join(actual, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected %v, got %v", expected, actual)
+	}
+}
+
+func TestNodeChildNilMap(t *testing.T) {
+	nd := &node[interface{}]{}
+	if c, ok := nd.Child('a'); ok || c != nil {
+		t.Errorf("Expected no child on a node without a children map, got %v", c)
+	}
+	if n := findNode(nd, []rune("abc")); n != nil {
+		t.Errorf("Expected findNode to miss on a node without a children map, got %v", n)
+	}
+	if n := findNode(nd, nil); n != nd {
+		t.Errorf("Expected findNode with no runes to return the node itself")
+	}
+}
+
+func TestPop(t *testing.T) {
+	trie := New[int]()
+	trie.Add("foo", 1)
+	trie.Add("foobar", 2)
+	trie.Add("bar", 3)
+
+	if meta, ok := trie.Pop("foo"); !ok || meta != 1 {
+		t.Errorf("Expected to pop foo with meta 1, got %d, %v", meta, ok)
+	}
+	if _, ok := trie.Find("foo"); ok {
+		t.Error("Expected foo to be removed")
+	}
+	if meta, ok := trie.Pop("foo"); ok || meta != 0 {
+		t.Errorf("Expected popping foo again to miss, got %d, %v", meta, ok)
+	}
+	if _, ok := trie.Pop("fo"); ok {
+		t.Error("Expected popping a bare prefix to miss")
+	}
+
+	if keys := trie.PrefixSearch("foo"); len(keys) != 1 || keys[0] != "foobar" {
+		t.Errorf("Expected [foobar], got %v", keys)
+	}
+	if err := trie.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFuzzySearchSortingRuneLength(t *testing.T) {
+	// "日本語" is three runes but nine bytes, so it belongs with the
+	// three rune ASCII key, ahead of the four rune one.
+	actual := []string{"日本語", "abcd", "abc"}
+	sort.Sort(ByKeys(actual))
+	expected := []string{"abc", "日本語", "abcd"}
+	if strings.Join(actual, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected %v, got %v", expected, actual)
+	}
+
+	trie := New[interface{}]()
+	for _, key := range []string{"x日本語", "xabcdef", "xab"} {
+		trie.Add(key, nil)
+	}
+	actual = trie.FuzzySearch("x")
+	expected = []string{"xab", "x日本語", "xabcdef"}
+	if strings.Join(actual, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected %v, got %v", expected, actual)
+	}
+}
+
+func TestPrefixSearchMulti(t *testing.T) {
+	trie := New[interface{}]()
+	for _, key := range []string{"foo", "foobar", "football", "bar", "bark", "zum"} {
+		trie.Add(key, nil)
+	}
+
+	groups := trie.PrefixSearchMulti([]string{"foo", "bar", "foot", "nope"})
+	if len(groups) != 4 {
+		t.Fatalf("Expected 4 groups, got %v", groups)
+	}
+
+	expected := map[string][]string{
+		"foo":  {"foo", "foobar", "football"},
+		"bar":  {"bar", "bark"},
+		"foot": {"football"},
+		"nope": nil,
+	}
+	for pre, want := range expected {
+		got := groups[pre]
+		sort.Strings(got)
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("%s: expected %v, got %v", pre, want, got)
+		}
+	}
+
+	// Groups must not share backing storage.
+	groups["foot"][0] = "changed"
+	if slices.Contains(groups["foo"], "changed") {
+		t.Error("Expected groups to be independent")
+	}
+}
+
+func TestWithMaxNodes(t *testing.T) {
+	// "foo" takes three rune nodes and a terminal.
+	trie := New(WithMaxNodes[int](6))
+	if trie.Add("foo", 1) == nil {
+		t.Fatal("Expected foo to fit")
+	}
+	// "foobar" shares "foo" but needs four more nodes.
+	if trie.Add("foobar", 2) != nil {
+		t.Error("Expected foobar to be rejected")
+	}
+	if _, ok := trie.Find("foobar"); ok {
+		t.Error("Expected rejected key to be absent")
+	}
+	// Keys on the stored path only need their terminal.
+	if trie.Add("f", 3) == nil {
+		t.Error("Expected f to fit")
+	}
+	if trie.Add("fo", 4) == nil {
+		t.Error("Expected fo to fit exactly at the cap")
+	}
+	if trie.Add("b", 5) != nil {
+		t.Error("Expected b to be rejected at the cap")
+	}
+	// Replacing the meta of a stored key needs no new nodes.
+	if n := trie.Add("foo", 6); n == nil || n.Meta() != 6 {
+		t.Error("Expected re-adding foo to succeed at the cap")
+	}
+	if n := len(trie.Keys()); n != 3 {
+		t.Errorf("Expected 3 keys, got %d", n)
+	}
+
+	// Removing foo frees its last rune and terminal.
+	trie.Remove("foo")
+	if trie.Add("fob", 2) == nil {
+		t.Error("Expected fob to fit after removing foo")
+	}
+	if err := trie.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAncestorMetas(t *testing.T) {
+	trie := New[string]()
+	trie.Add("/a", "read")
+	trie.Add("/a/b", "write")
+	trie.Add("/a/b/c", "admin")
+	trie.Add("/a/bc", "none")
+
+	tests := []struct {
+		key      string
+		expected []string
+	}{
+		{"/a/b/c", []string{"read", "write", "admin"}},
+		{"/a/b/cd", []string{"read", "write", "admin"}},
+		{"/a/b/", []string{"read", "write"}},
+		{"/a", []string{"read"}},
+		{"/", nil},
+		{"/x", nil},
+	}
+	for _, test := range tests {
+		actual := trie.AncestorMetas(test.key)
+		if strings.Join(actual, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("AncestorMetas(%q): expected %v, got %v", test.key, test.expected, actual)
+		}
+	}
+
+	// The empty key is a prefix of every key.
+	rooted := New[int]()
+	rooted.Add("", 1)
+	rooted.Add("/a", 2)
+	rooted.Add("/a/b", 3)
+	if actual := rooted.AncestorMetas("/a/b"); fmt.Sprint(actual) != "[1 2 3]" {
+		t.Errorf("Expected [1 2 3], got %v", actual)
+	}
+	if actual := rooted.AncestorMetas(""); fmt.Sprint(actual) != "[1]" {
+		t.Errorf("Expected [1] for the empty key, got %v", actual)
+	}
+}
+
+func TestToMap(t *testing.T) {
+	m := map[string]int{"foo": 1, "foobar": 2, "bar": 3, "日本": 4}
+	trie := New[int]()
+	for key, meta := range m {
+		trie.Add(key, meta)
+	}
+
+	actual := trie.ToMap()
+	if len(actual) != len(m) {
+		t.Fatalf("Expected %d entries, got %v", len(m), actual)
+	}
+	for key, meta := range m {
+		if got, ok := actual[key]; !ok || got != meta {
+			t.Errorf("%s: expected %d, got %d", key, meta, got)
+		}
+	}
+
+	if m := New[int]().ToMap(); m == nil || len(m) != 0 {
+		t.Errorf("Expected an empty map, got %v", m)
+	}
+}
+
+func TestFromMap(t *testing.T) {
+	m := map[string]int{"foo": 1, "foobar": 2, "bar": 3, "": 4}
+	trie := FromMap(m)
+
+	actual := trie.ToMap()
+	if len(actual) != len(m) {
+		t.Fatalf("Expected %v, got %v", m, actual)
+	}
+	for key, meta := range m {
+		if got, ok := actual[key]; !ok || got != meta {
+			t.Errorf("%q: expected %d, got %d", key, meta, got)
+		}
+	}
+	if err := trie.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSoftDelete(t *testing.T) {
+	trie := New[int]()
+	for i, key := range []string{"foo", "foobar", "food", "bar"} {
+		trie.Add(key, i)
+	}
+
+	if !trie.SoftDelete("foobar") || !trie.SoftDelete("bar") {
+		t.Fatal("Expected stored keys to be soft-deleted")
+	}
+	if trie.SoftDelete("foobar") || trie.SoftDelete("fo") {
+		t.Error("Expected soft-deleting a missing key to fail")
+	}
+
+	if _, ok := trie.Find("foobar"); ok {
+		t.Error("Expected Find to skip a soft-deleted key")
+	}
+	keys := trie.Keys()
+	sort.Strings(keys)
+	if strings.Join(keys, ",") != "foo,food" {
+		t.Errorf("Expected [foo food], got %v", keys)
+	}
+	if keys := trie.FuzzySearch("fb"); len(keys) != 0 {
+		t.Errorf("Expected no fuzzy matches, got %v", keys)
+	}
+	if trie.HasKeysWithPrefix("ba") {
+		t.Error("Expected no keys beneath a soft-deleted key")
+	}
+	if key, ok := trie.Next("food"); ok {
+		t.Errorf("Expected no key after food, got %q", key)
+	}
+	if key, ok := trie.Prev("foo"); ok {
+		t.Errorf("Expected no key before foo, got %q", key)
+	}
+	if err := trie.Validate(); err != nil {
+		t.Error(err)
+	}
+
+	if !trie.Resurrect("foobar") {
+		t.Fatal("Expected foobar to be resurrected")
+	}
+	if trie.Resurrect("foobar") || trie.Resurrect("food") {
+		t.Error("Expected resurrecting a live key to fail")
+	}
+	if n, ok := trie.Find("foobar"); !ok || n.Meta() != 1 {
+		t.Error("Expected foobar to be back with its meta data")
+	}
+
+	// Adding a soft-deleted key restores it with the new meta data.
+	trie.SoftDelete("foo")
+	if n := trie.Add("foo", 9); n.Meta() != 9 {
+		t.Errorf("Expected foo to be re-added with meta 9")
+	}
+	if keys := trie.Keys(); len(keys) != 3 {
+		t.Errorf("Expected 3 keys, got %v", keys)
+	}
+
+	trie.SoftDelete("food")
+	if n := trie.PurgeTombstones(); n != 2 {
+		t.Errorf("Expected 2 tombstones purged, got %d", n)
+	}
+	if trie.Resurrect("bar") || trie.Resurrect("food") {
+		t.Error("Expected purged keys to be gone")
+	}
+	keys = trie.Keys()
+	sort.Strings(keys)
+	if strings.Join(keys, ",") != "foo,foobar" {
+		t.Errorf("Expected [foo foobar], got %v", keys)
+	}
+	if err := trie.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPrefixSearchExcluding(t *testing.T) {
+	trie := New[interface{}]()
+	for _, key := range []string{"foo", "foobar", "football", "foosball", "bar"} {
+		trie.Add(key, nil)
+	}
+
+	exclude := map[string]struct{}{"foo": {}, "football": {}, "bar": {}}
+	actual := trie.PrefixSearchExcluding("foo", exclude)
+	sort.Strings(actual)
+	expected := []string{"foobar", "foosball"}
+	if strings.Join(actual, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected %v, got %v", expected, actual)
+	}
+
+	if keys := trie.PrefixSearchExcluding("baz", nil); keys != nil {
+		t.Errorf("Expected nil for an unknown prefix, got %v", keys)
+	}
+}
+
+func TestWithRuneTransform(t *testing.T) {
+	latin := map[rune]rune{'п': 'p', 'р': 'r', 'и': 'i', 'в': 'v', 'е': 'e', 'т': 't', 'м': 'm', 'а': 'a'}
+	transliterate := func(r rune) rune {
+		if l, ok := latin[r]; ok {
+			return l
+		}
+		return r
+	}
+
+	trie := New(WithRuneTransform[interface{}](transliterate))
+	for _, key := range []string{"привет", "мир", "print"} {
+		trie.Add(key, nil)
+	}
+
+	actual := trie.FuzzySearch("privet")
+	if len(actual) != 1 || actual[0] != "привет" {
+		t.Errorf("Expected [привет], got %v", actual)
+	}
+	actual = trie.FuzzySearch("pri")
+	expected := []string{"print", "привет"}
+	if strings.Join(actual, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected %v, got %v", expected, actual)
+	}
+
+	// Transforms compose with diacritic folding.
+	trie = New(WithDiacriticFolding[interface{}](), WithRuneTransform[interface{}](transliterate))
+	trie.Add("Привет", nil)
+	if actual := trie.FuzzySearch("privet"); len(actual) != 1 {
+		t.Errorf("Expected to match Привет, got %v", actual)
+	}
+}
+
+func TestCheckInvariants(t *testing.T) {
+	trie := New[interface{}]()
+	for _, key := range []string{"foo", "foobar", "bar", "baz"} {
+		trie.Add(key, nil)
+	}
+	trie.Remove("baz")
+	if problems := trie.CheckInvariants(); len(problems) != 0 {
+		t.Fatalf("Expected no problems, got %v", problems)
+	}
+
+	fo := findNode(trie.root, []rune("fo"))
+	fo.termCount++
+	fo.mask = 0
+	ba := findNode(trie.root, []rune("ba"))
+	r, _ := ba.Child('r')
+	r.parent = fo
+
+	// Clearing fo's mask also leaves f's mask disagreeing with it.
+	problems := trie.CheckInvariants()
+	if len(problems) != 4 {
+		t.Fatalf("Expected 4 problems, got %q", problems)
+	}
+	for _, want := range []string{"termCount 3", "has mask 0", "does not point back"} {
+		found := false
+		for _, p := range problems {
+			found = found || strings.Contains(p, want)
+		}
+		if !found {
+			t.Errorf("Expected a problem mentioning %q in %q", want, problems)
+		}
+	}
+	if err := trie.Validate(); err == nil {
+		t.Error("Expected Validate to report the problems")
+	}
+}
+
+func TestPrefixFacets(t *testing.T) {
+	trie := New[interface{}]()
+	for _, key := range []string{"foo", "foobar", "football", "foosball", "fab", "bar"} {
+		trie.Add(key, nil)
+	}
+
+	tests := []struct {
+		pre      string
+		depth    int
+		expected []Facet
+	}{
+		// "foo" itself is a key but has no next rune, so it only counts
+		// towards the prefix.
+		{"foo", 1, []Facet{{"foob", 1}, {"foos", 1}, {"foot", 1}}},
+		{"f", 1, []Facet{{"fa", 1}, {"fo", 4}}},
+		{"f", 2, []Facet{{"fab", 1}, {"foo", 4}}},
+		{"", 1, []Facet{{"b", 1}, {"f", 5}}},
+		{"x", 1, nil},
+	}
+	for _, test := range tests {
+		actual := trie.PrefixFacets(test.pre, test.depth)
+		if fmt.Sprint(actual) != fmt.Sprint(test.expected) {
+			t.Errorf("PrefixFacets(%q, %d): expected %v, got %v", test.pre, test.depth, test.expected, actual)
+		}
+	}
+}
+
+func TestFuzzySearchWeighted(t *testing.T) {
+	trie := New[float64]()
+	trie.Add("fab", 0)
+	trie.Add("football", 1)
+	trie.Add("foosball", 0)
+	weight := func(w float64) float64 { return w }
+
+	// fab matches 2 of its 3 runes, football only 2 of 8, but football's
+	// weight makes up for it.
+	actual := trie.FuzzySearchWeighted("fb", weight)
+	expected := []string{"football", "fab", "foosball"}
+	if len(actual) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, actual)
+	}
+	for i, e := range actual {
+		if e.Key != expected[i] {
+			t.Errorf("Expected %v, got %v", expected, actual)
+			break
+		}
+	}
+	if s := actual[1].Score; s < 0.33 || s > 0.34 {
+		t.Errorf("Expected fab to score 1/3, got %f", s)
+	}
+
+	// Without any weight the better match wins.
+	trie = New(WithWeightBlend[float64](0))
+	trie.Add("fab", 0)
+	trie.Add("football", 1)
+	if actual := trie.FuzzySearchWeighted("fb", weight); actual[0].Key != "fab" {
+		t.Errorf("Expected fab first, got %v", actual)
+	}
+}
+
+func TestShrinkToFit(t *testing.T) {
+	trie := New[int]()
+	for i := 0; i < 1000; i++ {
+		trie.Add("key"+strconv.Itoa(i), i)
+	}
+	for i := 0; i < 1000; i++ {
+		if i%100 != 0 {
+			trie.Remove("key" + strconv.Itoa(i))
+		}
+	}
+
+	// Every remaining key gives up its empty children map.
+	if n := trie.ShrinkToFit(); n != 10 {
+		t.Errorf("Expected 10 maps dropped, got %d", n)
+	}
+	if n := trie.ShrinkToFit(); n != 0 {
+		t.Errorf("Expected nothing left to drop, got %d", n)
+	}
+
+	if n, ok := trie.Find("key500"); !ok || n.Meta() != 500 {
+		t.Error("Expected key500 to survive shrinking")
+	}
+	if keys := trie.PrefixSearch("key"); len(keys) != 10 {
+		t.Errorf("Expected 10 keys, got %v", keys)
+	}
+	trie.Add("key5000", 5000)
+	trie.Add("key12", 12)
+	trie.Remove("key500")
+	if keys := trie.PrefixSearch("key50"); len(keys) != 1 || keys[0] != "key5000" {
+		t.Errorf("Expected [key5000], got %v", keys)
+	}
+	if err := trie.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAddValidated(t *testing.T) {
+	trie := New[int]()
+	if n, err := trie.AddValidated("José", 1); err != nil || n.Meta() != 1 {
+		t.Fatalf("Expected valid key to be added, got %v", err)
+	}
+	if n, err := trie.AddValidated("bad\xffkey", 2); err != ErrInvalidUTF8 || n != nil {
+		t.Errorf("Expected ErrInvalidUTF8, got %v", err)
+	}
+	if _, ok := trie.Find("bad\xffkey"); ok {
+		t.Error("Expected the invalid key not to be stored")
+	}
+
+	// Add stays permissive.
+	if n := trie.Add("bad\xffkey", 2); n == nil {
+		t.Error("Expected Add to accept the invalid key")
+	}
+
+	trie = New(WithMaxNodes[int](2))
+	if _, err := trie.AddValidated("abc", 1); err != ErrNodeLimit {
+		t.Errorf("Expected ErrNodeLimit, got %v", err)
+	}
+}
+
+func TestDepthHistogram(t *testing.T) {
+	trie := New[interface{}]()
+	for _, key := range []string{"ab", "ac", "b"} {
+		trie.Add(key, nil)
+	}
+
+	// Depth 1 holds a and b, depth 2 holds c, b's marker and the b of
+	// ab, and depth 3 the markers of ab and ac.
+	expected := map[int]int{0: 1, 1: 2, 2: 3, 3: 2}
+	actual := trie.DepthHistogram()
+	if fmt.Sprint(actual) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v, got %v", expected, actual)
+	}
+}
+
+func TestRemovePrefixKeys(t *testing.T) {
+	trie := New[interface{}]()
+	for _, key := range []string{"foo", "foobar", "football", "fo", "bar"} {
+		trie.Add(key, nil)
+	}
+
+	removed := trie.RemovePrefixKeys("foo")
+	sort.Strings(removed)
+	expected := []string{"foo", "foobar", "football"}
+	if strings.Join(removed, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected %v, got %v", expected, removed)
+	}
+	for _, key := range expected {
+		if _, ok := trie.Find(key); ok {
+			t.Errorf("Expected %s to be removed", key)
+		}
+	}
+
+	keys := trie.Keys()
+	sort.Strings(keys)
+	if strings.Join(keys, ",") != "bar,fo" {
+		t.Errorf("Expected [bar fo] to remain, got %v", keys)
+	}
+	if keys := trie.FuzzySearch("ob"); len(keys) != 0 {
+		t.Errorf("Expected no stale fuzzy matches, got %v", keys)
+	}
+	if err := trie.Validate(); err != nil {
+		t.Error(err)
+	}
+
+	if removed := trie.RemovePrefixKeys("x"); removed != nil {
+		t.Errorf("Expected nothing removed, got %v", removed)
+	}
+
+	for _, opts := range [][]Option[int]{nil, {WithLockFreeReads[int]()}} {
+		trie := New(opts...)
+		for i, key := range []string{"a", "abc", "abd", "b", "bcd"} {
+			trie.Add(key, i)
+		}
+		trie.AddTag("abd", "tagged")
+		trie.SoftDelete("bcd")
+
+		// The branch under "abc" and "abd" goes, up to "a", which stays.
+		if removed := trie.RemovePrefixKeys("ab"); len(removed) != 2 {
+			t.Errorf("Expected 2 keys removed, got %v", removed)
+		}
+		if problems := trie.CheckInvariants(); len(problems) != 0 {
+			t.Error(problems)
+		}
+		if tagged := trie.KeysWithTag("tagged"); len(tagged) != 0 {
+			t.Errorf("Expected the tag to go with its key, got %v", tagged)
+		}
+		// "bcd" was soft-deleted and goes with the only key beside it.
+		if removed := trie.RemovePrefixKeys("b"); len(removed) != 1 || trie.Resurrect("bcd") {
+			t.Errorf("Expected only b removed, and bcd with it, got %v", removed)
+		}
+		if problems := trie.CheckInvariants(); len(problems) != 0 {
+			t.Error(problems)
+		}
+		if keys := trie.Keys(); len(keys) != 1 || keys[0] != "a" {
+			t.Errorf("Expected [a] to remain, got %v", keys)
+		}
+		if removed := trie.RemovePrefixKeys(""); len(removed) != 1 || !trie.IsEmpty() {
+			t.Errorf("Expected the last key removed, got %v", removed)
+		}
+		if problems := trie.CheckInvariants(); len(problems) != 0 {
+			t.Error(problems)
+		}
+	}
+}
+
+func TestMap(t *testing.T) {
+	counts := New[int]()
+	for i, key := range []string{"foo", "foobar", "bar", "日本"} {
+		counts.Add(key, i+1)
+	}
+	counts.SetPrefixMeta("fo", 10)
+
+	doubled := Map(counts, func(n int) float64 { return float64(n) * 2 })
+	expected := map[string]float64{"foo": 2, "foobar": 4, "bar": 6, "日本": 8}
+	actual := doubled.ToMap()
+	if fmt.Sprint(actual) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v, got %v", expected, actual)
+	}
+	if meta, ok := doubled.GetPrefixMeta("fo"); !ok || meta != 20 {
+		t.Errorf("Expected prefix meta 20, got %v", meta)
+	}
+	if err := doubled.Validate(); err != nil {
+		t.Error(err)
+	}
+
+	// The copy is independent of the original.
+	doubled.Remove("foo")
+	doubled.Add("baz", 1)
+	if _, ok := counts.Find("foo"); !ok {
+		t.Error("Expected foo to remain in the original")
+	}
+	if _, ok := counts.Find("baz"); ok {
+		t.Error("Expected baz not to appear in the original")
+	}
+	if keys := doubled.FuzzySearch("fb"); len(keys) != 1 || keys[0] != "foobar" {
+		t.Errorf("Expected [foobar], got %v", keys)
+	}
+
+	// The copy calls the same collator under the same lock.
+	collated := New(WithCollator[int](&exclusiveCollator{t: t}))
+	for i := 0; i < 50; i++ {
+		collated.Add(strconv.Itoa(i), i)
+	}
+	sortConcurrently(collated, Map(collated, func(n int) int { return n }))
+
+	o := &recordingObserver{searches: make(map[string]int)}
+	observed := New(WithObserver[int](o), WithKeysOnly[int]())
+	observed.Add("foo", 0)
+	mapped := Map(observed, func(int) string { return "meta" })
+	if n, ok := mapped.Find("foo"); !ok || n.Meta() != "" {
+		t.Errorf("Expected foo without meta data, got %v", n)
+	}
+	if o.hits != 1 {
+		t.Errorf("Expected the copy to keep the observer, got %d hits", o.hits)
+	}
+}
+
+func TestSortedChildren(t *testing.T) {
+	trie := New[interface{}]()
+	for _, key := range []string{"fz", "f", "fa", "f日", "fm"} {
+		trie.Add(key, nil)
+	}
+
+	nd := findNode(trie.root, []rune("f"))
+	var runes []rune
+	for _, c := range nd.SortedChildren() {
+		runes = append(runes, c.val)
+	}
+	expected := []rune{nul, 'a', 'm', 'z', '日'}
+	if string(runes) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, runes)
+	}
+
+	if children := (&node[interface{}]{}).SortedChildren(); len(children) != 0 {
+		t.Errorf("Expected no children, got %v", children)
+	}
+}
+
+func TestContainsAll(t *testing.T) {
+	trie := New[interface{}]()
+	for _, key := range []string{"foo", "foobar", "bar"} {
+		trie.Add(key, nil)
+	}
+
+	keys := []string{"foo", "fo", "bar", "baz", "foobar", "", "foo"}
+	expected := []bool{true, false, true, false, true, false, true}
+	actual := trie.ContainsAll(keys)
+	if fmt.Sprint(actual) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v, got %v", expected, actual)
+	}
+	if actual := trie.ContainsAll(nil); len(actual) != 0 {
+		t.Errorf("Expected an empty result, got %v", actual)
+	}
+}
+
+// expiringContext reports itself cancelled once Err has been called
+// more than checks times, cancelling a search partway through.
+type expiringContext struct {
+	context.Context
+	checks int
+}
+
+func (c *expiringContext) Err() error {
+	if c.checks == 0 {
+		return context.Canceled
+	}
+	c.checks--
+	return nil
+}
+
+func TestFuzzySearchContext(t *testing.T) {
+	trie := New[interface{}]()
+	for i := 0; i < 2000; i++ {
+		trie.Add("key"+strconv.Itoa(i), nil)
+	}
+
+	keys, err := trie.FuzzySearchContext(context.Background(), "k99")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := trie.FuzzySearch("k99"); strings.Join(keys, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected %v, got %v", expected, keys)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if keys, err := trie.FuzzySearchContext(ctx, "k99"); err != context.Canceled || len(keys) != 0 {
+		t.Errorf("Expected a cancelled search, got %v, %v", keys, err)
+	}
+
+	// A search cut short keeps the matches it had found.
+	ctx = &expiringContext{Context: context.Background(), checks: 5}
+	partial, err := trie.FuzzySearchContext(ctx, "k99")
+	if err != context.Canceled {
+		t.Fatalf("Expected the search to be cancelled partway, got %v", err)
+	}
+	if len(partial) == 0 || len(partial) >= len(keys) {
+		t.Fatalf("Expected some but not all of %d matches, got %d", len(keys), len(partial))
+	}
+	for _, key := range partial {
+		if !slices.Contains(keys, key) {
+			t.Errorf("Unexpected partial match %q", key)
+		}
+	}
+	if !sort.IsSorted(ByKeys(partial)) {
+		t.Errorf("Expected partial matches in FuzzySearch order, got %v", partial)
+	}
+
+	// Queries matching at or next to root leave the rest of the work to
+	// collecting the matched subtree, which must be cancellable too.
+	for _, q := range []string{"", "k"} {
+		ctx = &expiringContext{Context: context.Background(), checks: 2}
+		partial, err := trie.FuzzySearchContext(ctx, q)
+		if err != context.Canceled {
+			t.Errorf("FuzzySearchContext(%q): expected a cancelled search, got %v", q, err)
+		}
+		if len(partial) >= 2000 {
+			t.Errorf("FuzzySearchContext(%q): expected fewer than all keys, got %d", q, len(partial))
+		}
+	}
+}
+
+func TestReader(t *testing.T) {
+	trie := New[int]()
+	for i := 0; i < 100; i++ {
+		trie.Add("key"+strconv.Itoa(i), i)
+	}
+
+	r := trie.Reader()
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				key := "key" + strconv.Itoa(i)
+				if n, ok := r.Find(key); !ok || n.Meta() != i {
+					t.Errorf("Expected to find %s", key)
+				}
+			}
+			if keys := r.PrefixSearch("key9"); len(keys) != 11 {
+				t.Errorf("Expected 11 keys with prefix key9, got %v", keys)
+			}
+			if keys := r.FuzzySearch("k99"); len(keys) != 1 {
+				t.Errorf("Expected [key99], got %v", keys)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// A write waits for the Reader to close.
+	added := make(chan struct{})
+	go func() {
+		trie.Add("key100", 100)
+		close(added)
+	}()
+	select {
+	case <-added:
+		t.Fatal("Expected Add to block while the Reader is open")
+	case <-time.After(10 * time.Millisecond):
+	}
+	r.Close()
+	r.Close()
+	<-added
+	if _, ok := trie.Find("key100"); !ok {
+		t.Error("Expected key100 to be added once the Reader closed")
+	}
+}
+
+func TestLongestCommonPrefix(t *testing.T) {
+	tests := []struct {
+		keys     []string
+		expected string
+	}{
+		{[]string{"interest", "internet"}, "inter"},
+		{[]string{"interest", "internet", "inter"}, "inter"},
+		{[]string{"interest", "internet", "in"}, "in"},
+		{[]string{"foo"}, "foo"},
+		{[]string{"foo", "bar"}, ""},
+		{[]string{"foo", ""}, ""},
+		{nil, ""},
+	}
+	for _, test := range tests {
+		trie := New[interface{}]()
+		for _, key := range test.keys {
+			trie.Add(key, nil)
+		}
+		if actual := trie.LongestCommonPrefix(); actual != test.expected {
+			t.Errorf("LongestCommonPrefix of %q: expected %q, got %q", test.keys, test.expected, actual)
+		}
+	}
+
+	trie := New[interface{}]()
+	for _, key := range []string{"interest", "internet", "inbox"} {
+		trie.Add(key, nil)
+	}
+	trie.SoftDelete("inbox")
+	if actual := trie.LongestCommonPrefix(); actual != "inter" {
+		t.Errorf("Expected soft-deleted keys to be ignored, got %q", actual)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	trie := New[interface{}]()
+	for _, key := range []string{"foo", "foobar", "football", "bar", "f*", "~x"} {
+		trie.Add(key, nil)
+	}
+
+	tests := []struct {
+		q        string
+		expected []string
+	}{
+		{"foo*", []string{"foo", "foobar", "football"}},
+		{"~fb", []string{"foobar", "football"}},
+		{"~ba", []string{"bar", "foobar", "football"}},
+		{"foo", []string{"foo"}},
+		{"fo", nil},
+		// Sigils are only syntax: the fuzzy search for x finds the key ~x.
+		{"~x", []string{"~x"}},
+		{"f*", []string{"f*", "foo", "foobar", "football"}},
+		{"*", []string{"bar", "f*", "foo", "foobar", "football", "~x"}},
+		{"nope*", nil},
+	}
+	for _, test := range tests {
+		actual := trie.Query(test.q)
+		sort.Strings(actual)
+		if strings.Join(actual, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("Query(%q): expected %v, got %v", test.q, test.expected, actual)
+		}
+	}
+}
+
+func TestMetaHistogram(t *testing.T) {
+	trie := New[string]()
+	categories := map[string]string{
+		"apple": "fruit", "banana": "fruit", "cherry": "fruit",
+		"carrot": "vegetable", "leek": "vegetable",
+		"salt": "",
+	}
+	for key, category := range categories {
+		trie.Add(key, category)
+	}
+
+	expected := map[string]int{"fruit": 3, "vegetable": 2, "": 1}
+	actual := trie.MetaHistogram(func(c string) string { return c })
+	if fmt.Sprint(actual) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v, got %v", expected, actual)
+	}
+
+	byLength := trie.MetaHistogram(func(c string) string { return strconv.Itoa(len(c)) })
+	if byLength["5"] != 3 || byLength["9"] != 2 || byLength["0"] != 1 {
+		t.Errorf("Unexpected histogram %v", byLength)
+	}
+}
+
+func TestRandomKey(t *testing.T) {
+	trie := New[interface{}]()
+	keys := []string{"a", "ab", "abc", "abd", "b", "bcdef", "c", "日本"}
+	for _, key := range keys {
+		trie.Add(key, nil)
+	}
+	trie.Add("zzz", nil)
+	trie.SoftDelete("zzz")
+
+	const draws = 80000
+	rng := rand.New(rand.NewSource(1))
+	counts := make(map[string]int)
+	for i := 0; i < draws; i++ {
+		key, ok := trie.RandomKey(rng)
+		if !ok {
+			t.Fatal("Expected a key")
+		}
+		counts[key]++
+	}
+
+	if len(counts) != len(keys) {
+		t.Fatalf("Expected every key to be drawn, got %v", counts)
+	}
+	expected := draws / len(keys)
+	for _, key := range keys {
+		// Allow 5% either way; the standard deviation is about 1%.
+		if c := counts[key]; c < expected*95/100 || c > expected*105/100 {
+			t.Errorf("Expected about %d draws of %q, got %d", expected, key, c)
+		}
+	}
+
+	if _, ok := New[interface{}]().RandomKey(rng); ok {
+		t.Error("Expected no key from an empty trie")
+	}
+}
+
+func TestSamplePrefix(t *testing.T) {
+	trie := New[interface{}]()
+	for i := 0; i < 50; i++ {
+		trie.Add("key"+strconv.Itoa(i), nil)
+	}
+	trie.Add("other", nil)
+
+	rng := rand.New(rand.NewSource(1))
+	for _, n := range []int{0, 1, 10, 50, 100} {
+		sample := trie.SamplePrefix("key", n, rng)
+		if len(sample) != min(n, 50) {
+			t.Errorf("SamplePrefix(%d): expected %d keys, got %d", n, min(n, 50), len(sample))
+		}
+		seen := make(map[string]bool)
+		for _, key := range sample {
+			if seen[key] || !strings.HasPrefix(key, "key") {
+				t.Errorf("SamplePrefix(%d): unexpected or repeated key %q", n, key)
+			}
+			seen[key] = true
+		}
+	}
+
+	// Every key should turn up in roughly its share of samples.
+	counts := make(map[string]int)
+	for i := 0; i < 5000; i++ {
+		for _, key := range trie.SamplePrefix("key", 5, rng) {
+			counts[key]++
+		}
+	}
+	if len(counts) != 50 {
+		t.Errorf("Expected every key to be sampled, got %d", len(counts))
+	}
+	for key, c := range counts {
+		if c < 350 || c > 650 {
+			t.Errorf("Expected about 500 samples of %q, got %d", key, c)
+		}
+	}
+
+	if sample := trie.SamplePrefix("nope", 5, rng); sample != nil {
+		t.Errorf("Expected no sample, got %v", sample)
+	}
+}
+
+func TestSegment(t *testing.T) {
+	trie := New[interface{}]()
+	trie.Add("foo", nil)
+	trie.Add("bar", nil)
+	if words, ok := trie.Segment("foobar"); !ok || strings.Join(words, "|") != "foo|bar" {
+		t.Errorf("Expected [foo bar], got %v, %v", words, ok)
+	}
+
+	for _, key := range []string{"foob", "a", "ar", "bark", "日本", "語"} {
+		trie.Add(key, nil)
+	}
+	tests := []struct {
+		s        string
+		expected []string
+		ok       bool
+	}{
+		// The longer first key wins when the rest can still be split.
+		{"foobar", []string{"foob", "ar"}, true},
+		{"foobarfoo", []string{"foob", "ar", "foo"}, true},
+		{"foobarr", nil, false},
+		// "foob" would leave "ark", so it falls back to "foo".
+		{"foobark", []string{"foo", "bark"}, true},
+		{"日本語", []string{"日本", "語"}, true},
+		{"", []string{}, true},
+		{"foobaz", nil, false},
+	}
+	for _, test := range tests {
+		actual, ok := trie.Segment(test.s)
+		if ok != test.ok || strings.Join(actual, "|") != strings.Join(test.expected, "|") {
+			t.Errorf("Segment(%q): expected %v, %v, got %v, %v", test.s, test.expected, test.ok, actual, ok)
+		}
+	}
+
+	if prefixes := trie.PrefixesOf("foobar"); strings.Join(prefixes, ",") != "foo,foob" {
+		t.Errorf("Expected [foo foob], got %v", prefixes)
+	}
+}
+
+type recordingObserver struct {
+	adds, hits, misses, removed, notRemoved int
+	searches                                map[string]int
+}
+
+func (o *recordingObserver) ObserveAdd(time.Duration) { o.adds++ }
+
+func (o *recordingObserver) ObserveFind(hit bool, _ time.Duration) {
+	if hit {
+		o.hits++
+	} else {
+		o.misses++
+	}
+}
+
+func (o *recordingObserver) ObserveRemove(found bool, _ time.Duration) {
+	if found {
+		o.removed++
+	} else {
+		o.notRemoved++
+	}
+}
+
+func (o *recordingObserver) ObserveSearch(method string, results int, _ time.Duration) {
+	o.searches[method] += results
+}
+
+func TestWithObserver(t *testing.T) {
+	o := &recordingObserver{searches: make(map[string]int)}
+	trie := New(WithObserver[interface{}](o))
+	for _, key := range []string{"foo", "foobar", "bar"} {
+		trie.Add(key, nil)
+	}
+	trie.Find("foo")
+	trie.Find("fo")
+	trie.Find("bar")
+	trie.Remove("bar")
+	trie.Remove("bar")
+	trie.PrefixSearch("foo")
+	trie.FuzzySearch("fb")
+	trie.Search("x")
+
+	if o.adds != 3 || o.hits != 2 || o.misses != 1 || o.removed != 1 || o.notRemoved != 1 {
+		t.Errorf("Unexpected counts %+v", o)
+	}
+	expected := map[string]int{"PrefixSearch": 2, "FuzzySearch": 1, "Search": 0}
+	if fmt.Sprint(o.searches) != fmt.Sprint(expected) {
+		t.Errorf("Expected searches %v, got %v", expected, o.searches)
+	}
+}
+
+func TestHasKeyOrPrefix(t *testing.T) {
+	trie := New[interface{}]()
+	trie.Add("foo", nil)
+	trie.Add("foobar", nil)
+	trie.Add("bark", nil)
+	trie.Add("bar", nil)
+	trie.SoftDelete("bark")
+
+	tests := []struct {
+		s        string
+		expected bool
+	}{
+		{"foo", true},
+		{"foobar", true},
+		{"foob", true},
+		{"", true},
+		{"bar", true},
+		{"bark", false},
+		{"baz", false},
+		{"foobarbaz", false},
+	}
+	for _, test := range tests {
+		if actual := trie.HasKeyOrPrefix(test.s); actual != test.expected {
+			t.Errorf("HasKeyOrPrefix(%q): expected %v", test.s, test.expected)
+		}
+	}
+	if New[interface{}]().HasKeyOrPrefix("") {
+		t.Error("Expected nothing in an empty trie")
+	}
+}
+
+func TestRemoveKeyPrefixOfOthers(t *testing.T) {
+	trie := New[int]()
+	trie.Add("foo", 1)
+	trie.Add("foobar", 2)
+	trie.Add("food", 3)
+	masks := findNode(trie.root, []rune("foo")).mask
+
+	trie.Remove("foo")
+	if _, ok := trie.Find("foo"); ok {
+		t.Error("Expected foo to be removed")
+	}
+	for key, meta := range map[string]int{"foobar": 2, "food": 3} {
+		if n, ok := trie.Find(key); !ok || n.Meta() != meta {
+			t.Errorf("Expected %s to survive with meta %d", key, meta)
+		}
+	}
+	nd := findNode(trie.root, []rune("foo"))
+	if _, ok := nd.Child(nul); ok {
+		t.Error("Expected the terminal marker of foo to be gone")
+	}
+	if nd.mask != masks || nd.termCount != 2 {
+		t.Errorf("Expected foo's node to keep its mask and count 2 keys, got %b, %d", nd.mask, nd.termCount)
+	}
+	if keys := trie.FuzzySearch("fob"); len(keys) != 1 || keys[0] != "foobar" {
+		t.Errorf("Expected [foobar], got %v", keys)
+	}
+	if err := trie.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOrderedPrefixSearch(t *testing.T) {
+	trie := New[interface{}]()
+	for _, key := range []string{"foosball", "football", "foo", "fo", "foo日", "food", "bar"} {
+		trie.Add(key, nil)
+	}
+
+	actual := trie.OrderedPrefixSearch("foo")
+	expected := []string{"foo", "food", "foosball", "football", "foo日"}
+	if strings.Join(actual, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected %v, got %v", expected, actual)
+	}
+	if keys := trie.OrderedPrefixSearch("x"); keys != nil {
+		t.Errorf("Expected nil, got %v", keys)
+	}
+}
+
+func TestIsEmpty(t *testing.T) {
+	trie := New[interface{}]()
+	if !trie.IsEmpty() {
+		t.Error("Expected a new trie to be empty")
+	}
+
+	trie.Add("foo", nil)
+	trie.Add("foo", nil)
+	if trie.IsEmpty() || len(trie.Keys()) != 1 {
+		t.Error("Expected a duplicate add to leave one key")
+	}
+	trie.Remove("foo")
+	if !trie.IsEmpty() {
+		t.Error("Expected the trie to be empty once its only key is removed")
+	}
+	trie.Remove("foo")
+	if !trie.IsEmpty() {
+		t.Error("Expected removing a missing key to keep the trie empty")
+	}
+
+	trie.Add("foo", nil)
+	trie.Add("foobar", nil)
+	trie.SoftDelete("foo")
+	trie.Remove("foobar")
+	if !trie.IsEmpty() {
+		t.Error("Expected soft-deleted keys not to count")
+	}
+}
+
+func TestWithIntermediateMeta(t *testing.T) {
+	type agg struct {
+		prefix string
+		hits   int
+	}
+
+	trie := New(WithIntermediateMeta(func(prefix string) agg { return agg{prefix: prefix} }))
+	trie.Add("foo", agg{hits: 1})
+	trie.Add("fob", agg{hits: 2})
+
+	for _, pre := range []string{"f", "fo", "foo", "fob"} {
+		meta, ok := trie.GetPrefixMeta(pre)
+		if !ok || meta.prefix != pre || meta.hits != 0 {
+			t.Errorf("GetPrefixMeta(%q): expected an aggregate for %q, got %+v, %v", pre, pre, meta, ok)
+		}
+	}
+	if n, _ := trie.Find("fob"); n.Meta().hits != 2 {
+		t.Error("Expected keys to keep their own meta data")
+	}
+	if _, ok := trie.GetPrefixMeta(""); ok {
+		t.Error("Expected the root to have no prefix meta data")
+	}
+}
+
+func TestUpdateMetas(t *testing.T) {
+	trie := New[int]()
+	trie.Add("foo", 1)
+	trie.Add("foobar", 2)
+	trie.Add("bar", 3)
+
+	applied := trie.UpdateMetas(map[string]int{"foo": 10, "bar": 30, "fo": 5, "baz": 6})
+	if applied != 2 {
+		t.Errorf("Expected 2 updates applied, got %d", applied)
+	}
+	expected := map[string]int{"foo": 10, "foobar": 2, "bar": 30}
+	if actual := trie.ToMap(); fmt.Sprint(actual) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v, got %v", expected, actual)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	trie := New[int]()
+	for i, key := range []string{"foo", "foobar", "bar", "baz", "fab", "日本"} {
+		trie.Add(key, i)
+	}
+
+	f := Filter(trie, func(key string, _ int) bool { return strings.HasPrefix(key, "f") })
+	expected := map[string]int{"foo": 0, "foobar": 1, "fab": 4}
+	if actual := f.ToMap(); fmt.Sprint(actual) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v, got %v", expected, actual)
+	}
+	if err := f.Validate(); err != nil {
+		t.Error(err)
+	}
+
+	// The result is independent of the original.
+	f.Remove("foo")
+	if _, ok := trie.Find("foo"); !ok {
+		t.Error("Expected foo to remain in the original")
+	}
+	if n := len(Filter(trie, func(string, int) bool { return false }).Keys()); n != 0 {
+		t.Errorf("Expected an empty trie, got %d keys", n)
+	}
+
+	o := &recordingObserver{searches: make(map[string]int)}
+	observed := New(WithObserver[int](o))
+	observed.Add("foo", 0)
+	Filter(observed, func(string, int) bool { return true }).Find("foo")
+	if o.hits != 1 {
+		t.Errorf("Expected the filtered trie to keep the observer, got %d hits", o.hits)
+	}
+
+	collated := New(WithCollator[int](&exclusiveCollator{t: t}))
+	for i := 0; i < 50; i++ {
+		collated.Add(strconv.Itoa(i), i)
+	}
+	sortConcurrently(collated, Filter(collated, func(string, int) bool { return true }))
+}
+
+func TestAddUintLookupUint(t *testing.T) {
+	ipv4 := func(a, b, c, d byte) uint64 {
+		return uint64(a)<<56 | uint64(b)<<48 | uint64(c)<<40 | uint64(d)<<32
+	}
+
+	routes := New[string]()
+	routes.AddUint(ipv4(10, 0, 0, 0), 8, "10/8")
+	routes.AddUint(ipv4(10, 1, 0, 0), 16, "10.1/16")
+	routes.AddUint(ipv4(10, 1, 2, 128), 25, "10.1.2.128/25")
+	routes.AddUint(ipv4(192, 168, 1, 1), 32, "host")
+
+	tests := []struct {
+		addr     uint64
+		expected string
+		ok       bool
+	}{
+		{ipv4(10, 9, 9, 9), "10/8", true},
+		{ipv4(10, 1, 200, 1), "10.1/16", true},
+		{ipv4(10, 1, 2, 127), "10.1/16", true},
+		{ipv4(10, 1, 2, 200), "10.1.2.128/25", true},
+		{ipv4(192, 168, 1, 1), "host", true},
+		{ipv4(192, 168, 1, 2), "", false},
+		{ipv4(11, 0, 0, 0), "", false},
+	}
+	for _, test := range tests {
+		meta, ok := routes.LookupUint(test.addr)
+		if meta != test.expected || ok != test.ok {
+			t.Errorf("LookupUint(%x): expected %q, %v, got %q, %v", test.addr, test.expected, test.ok, meta, ok)
+		}
+	}
+
+	// A zero-bit prefix is the default route.
+	routes.AddUint(0, 0, "default")
+	if meta, _ := routes.LookupUint(ipv4(11, 0, 0, 0)); meta != "default" {
+		t.Errorf("Expected the default route, got %q", meta)
+	}
+}
+
+func TestImmediateCompletions(t *testing.T) {
+	trie := New[interface{}]()
+	for _, key := range []string{"ca", "cat", "cats", "cab", "cb", "cap日", "ca日"} {
+		trie.Add(key, nil)
+	}
+
+	actual := trie.ImmediateCompletions("ca")
+	expected := []string{"cab", "cat", "ca日"}
+	if strings.Join(actual, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected %v, got %v", expected, actual)
+	}
+	if keys := trie.ImmediateCompletions("cats"); len(keys) != 0 {
+		t.Errorf("Expected no completions, got %v", keys)
+	}
+	if keys := trie.ImmediateCompletions("x"); keys != nil {
+		t.Errorf("Expected nil, got %v", keys)
+	}
+}
+
+func TestAddWith(t *testing.T) {
+	trie := New[int]()
+	sum := func(old, new int) int { return old + new }
+	for _, key := range []string{"foo", "bar", "foo", "foo", "foobar"} {
+		trie.AddWith(key, 2, sum)
+	}
+
+	expected := map[string]int{"foo": 6, "bar": 2, "foobar": 2}
+	if actual := trie.ToMap(); fmt.Sprint(actual) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v, got %v", expected, actual)
+	}
+	if err := trie.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestKeysBFS(t *testing.T) {
+	trie := New[interface{}]()
+	for _, key := range []string{"football", "a", "foo", "bar", "日本", "ab", "foobar", ""} {
+		trie.Add(key, nil)
+	}
+
+	keys := trie.KeysBFS()
+	if len(keys) != 8 {
+		t.Fatalf("Expected 8 keys, got %v", keys)
+	}
+	for i := 1; i < len(keys); i++ {
+		if utf8.RuneCountInString(keys[i-1]) > utf8.RuneCountInString(keys[i]) {
+			t.Errorf("Expected keys grouped by length, got %q", keys)
+			break
+		}
+	}
+}
+
+func TestSetTerminal(t *testing.T) {
+	trie := New(WithMissCache[int](8))
+	trie.Add("foobar", 1)
+	if _, ok := trie.Find("foo"); ok {
+		t.Fatal("Expected foo not to be a key yet")
+	}
+
+	// Promote an intermediate node.
+	if !trie.SetTerminal("foo", true, 2) {
+		t.Fatal("Expected the node at foo to exist")
+	}
+	if n, ok := trie.Find("foo"); !ok || n.Meta() != 2 {
+		t.Error("Expected foo to be a key with meta 2")
+	}
+	if n := len(trie.PrefixSearch("fo")); n != 2 {
+		t.Errorf("Expected 2 keys beneath fo, got %d", n)
+	}
+
+	// Demote it again.
+	if !trie.SetTerminal("foo", false, 0) {
+		t.Fatal("Expected the node at foo to exist")
+	}
+	if _, ok := trie.Find("foo"); ok {
+		t.Error("Expected foo to no longer be a key")
+	}
+	if _, ok := trie.Find("foobar"); !ok {
+		t.Error("Expected foobar to survive")
+	}
+	// Demoting a node that is not a key changes nothing.
+	if !trie.SetTerminal("fo", false, 0) || len(trie.Keys()) != 1 {
+		t.Error("Expected demoting fo to be a no-op")
+	}
+
+	if trie.SetTerminal("bar", true, 3) {
+		t.Error("Expected no node at bar")
+	}
+	if err := trie.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestApproxBytes(t *testing.T) {
+	trie := New[int]()
+	empty := trie.ApproxBytes()
+	if empty <= 0 {
+		t.Fatalf("Expected the root to take some space, got %d", empty)
+	}
+
+	add := func(from, to int) {
+		for i := from; i < to; i++ {
+			trie.Add(fmt.Sprintf("key%06d", i), i)
+		}
+	}
+	add(0, 1000)
+	first := trie.ApproxBytes() - empty
+	add(1000, 2000)
+	second := trie.ApproxBytes() - empty
+
+	// Keys with the same shape should cost about the same each.
+	if ratio := float64(second) / float64(first); ratio < 1.8 || ratio > 2.2 {
+		t.Errorf("Expected twice the keys to take about twice the space, got %d then %d", first, second)
+	}
+
+	trie.RemovePrefixKeys("key")
+	if n := trie.ApproxBytes(); n != empty {
+		t.Errorf("Expected removing every key to return to %d, got %d", empty, n)
+	}
+}
+
+func TestWithKeysOnly(t *testing.T) {
+	trie := New(WithKeysOnly[*[]byte]())
+	buf := make([]byte, 1<<10)
+	trie.Add("foo", &buf)
+	trie.Add("foobar", &buf)
+	trie.AddWith("bar", &buf, func(old, _ *[]byte) *[]byte { return old })
+
+	for _, key := range []string{"foo", "foobar", "bar"} {
+		if !trie.Contains(key) {
+			t.Errorf("Expected %s to be stored", key)
+		}
+		if n, ok := trie.Find(key); !ok || n.Meta() != nil {
+			t.Errorf("Expected %s to be found without its meta data", key)
+		}
+	}
+	if trie.Contains("fo") {
+		t.Error("Expected fo not to be stored")
+	}
+	if keys := trie.PrefixSearch("foo"); len(keys) != 2 {
+		t.Errorf("Expected 2 keys with prefix foo, got %v", keys)
+	}
+	if keys := trie.FuzzySearch("br"); len(keys) != 2 {
+		t.Errorf("Expected 2 fuzzy matches, got %v", keys)
+	}
+
+	// Meta data written other than through Add is discarded too.
+	if n := trie.UpdateMetas(map[string]*[]byte{"foo": &buf}); n != 1 {
+		t.Errorf("Expected 1 update, got %d", n)
+	}
+	trie.Each(func(_ string, meta **[]byte) { *meta = &buf })
+	trie.SetPrefixMeta("fo", &buf)
+	for _, key := range []string{"foo", "foobar", "bar"} {
+		if n, _ := trie.Find(key); n.Meta() != nil {
+			t.Errorf("Expected %s to keep no meta data", key)
+		}
+	}
+	if meta, _ := trie.GetPrefixMeta("fo"); meta != nil {
+		t.Error("Expected the prefix fo to keep no meta data")
+	}
+}
+
+type failingWriter struct {
+	n int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.n == 0 {
+		return 0, errors.New("write failed")
+	}
+	w.n--
+	return len(p), nil
+}
+
+func TestStreamPrefix(t *testing.T) {
+	trie := New[int]()
+	for _, key := range []string{"foo", "foobar", "foobaz", "bar"} {
+		trie.Add(key, 0)
+	}
+
+	var buf bytes.Buffer
+	n, err := trie.StreamPrefix(&buf, "foo", "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("Expected 3 keys written, got %d", n)
+	}
+	got := strings.Split(buf.String(), "\n")
+	sort.Strings(got)
+	if expected := []string{"foo", "foobar", "foobaz"}; !slices.Equal(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+
+	if n, err := trie.StreamPrefix(&buf, "qux", "\n"); n != 0 || err != nil {
+		t.Errorf("Expected nothing written for an unknown prefix, got %d, %v", n, err)
+	}
+
+	// The first key and separator succeed; the second key fails.
+	n, err = trie.StreamPrefix(&failingWriter{n: 2}, "foo", "\n")
+	if err == nil {
+		t.Error("Expected the write error to be returned")
+	}
+	if n != 1 {
+		t.Errorf("Expected 1 key written before the error, got %d", n)
+	}
+}
+
+func TestByteKeys(t *testing.T) {
+	latin1 := func(b []byte) []rune {
+		runes := make([]rune, len(b))
+		for i, c := range b {
+			runes[i] = rune(c)
+		}
+		return runes
+	}
+	trie := New(WithByteDecoder[int](latin1))
+
+	// "café" and "naïve" in Latin-1, neither of which is valid UTF-8.
+	keys := [][]byte{[]byte("caf\xe9"), []byte("na\xefve")}
+	for i, key := range keys {
+		trie.AddBytes(key, i)
+	}
+	for i, key := range keys {
+		n, ok := trie.FindBytes(key)
+		if !ok {
+			t.Fatalf("Expected %q to be found", key)
+		}
+		if n.Meta() != i {
+			t.Errorf("Expected meta %d for %q, got %d", i, key, n.Meta())
+		}
+		var back []byte
+		for _, r := range n.path {
+			back = append(back, byte(r))
+		}
+		if !bytes.Equal(back, key) {
+			t.Errorf("Expected %q to round-trip, got %q", key, back)
+		}
+	}
+	if _, ok := trie.Find("café"); !ok {
+		t.Error("Expected the decoded key to be stored as UTF-8")
+	}
+
+	utf8Trie := New[int]()
+	utf8Trie.AddBytes([]byte("café"), 1)
+	if _, ok := utf8Trie.FindBytes([]byte("café")); !ok {
+		t.Error("Expected byte keys to be decoded as UTF-8 by default")
+	}
+}
+
+func TestHammingSearch(t *testing.T) {
+	trie := New[int]()
+	for _, key := range []string{"ACGT", "ACGA", "TCGA", "AGGT", "TTTT", "ACG", "ACGTA"} {
+		trie.Add(key, 0)
+	}
+
+	cases := []struct {
+		query    string
+		maxDist  int
+		expected []string
+	}{
+		{"ACGT", 0, []string{"ACGT"}},
+		{"ACGT", 1, []string{"ACGT", "ACGA", "AGGT"}},
+		{"ACGT", 2, []string{"ACGT", "ACGA", "AGGT", "TCGA"}},
+		{"GGGG", 1, []string{}},
+		{"ACG", 0, []string{"ACG"}},
+		{"", 1, []string{}},
+	}
+	for _, c := range cases {
+		got := trie.HammingSearch(c.query, c.maxDist)
+		if !slices.Equal(got, c.expected) {
+			t.Errorf("HammingSearch(%q, %d): expected %v, got %v", c.query, c.maxDist, c.expected, got)
+		}
+	}
+}
+
+func TestRemoveAllAndRebuild(t *testing.T) {
+	for _, removed := range []int{10, 950} {
+		trie := New[int]()
+		for i := 0; i < 1000; i++ {
+			trie.Add(strconv.Itoa(i), i)
+		}
+		trie.AddTag("7", "lucky")
+		trie.AddTag("999", "last")
+
+		keys := []string{"nope"}
+		for i := 0; i < removed; i++ {
+			keys = append(keys, strconv.Itoa(i))
+		}
+		trie.RemoveAllAndRebuild(keys)
+
+		if trie.size != 1000-removed {
+			t.Errorf("Removing %d: expected %d keys, got %d", removed, 1000-removed, trie.size)
+		}
+		for i := 0; i < 1000; i++ {
+			key := strconv.Itoa(i)
+			n, ok := trie.Find(key)
+			if ok != (i >= removed) {
+				t.Fatalf("Removing %d: expected Find(%q) to report %t", removed, key, i >= removed)
+			}
+			if ok && n.Meta() != i {
+				t.Errorf("Removing %d: expected meta %d for %q, got %d", removed, i, key, n.Meta())
+			}
+		}
+		if problems := trie.CheckInvariants(); len(problems) != 0 {
+			t.Errorf("Removing %d: %v", removed, problems)
+		}
+		if tagged := trie.KeysWithTag("lucky"); len(tagged) != 0 {
+			t.Errorf("Removing %d: expected the removed key's tag to go, got %v", removed, tagged)
+		}
+		if tagged := trie.KeysWithTag("last"); len(tagged) != 1 || tagged[0] != "999" {
+			t.Errorf("Removing %d: expected [999] tagged last, got %v", removed, tagged)
+		}
+	}
+
+	// Absent and repeated keys do not count towards the threshold, so
+	// this batch removes one key without rebuilding.
+	trie := New[int]()
+	for i := 0; i < 100; i++ {
+		trie.Add(strconv.Itoa(i), i)
+	}
+	before, _ := trie.Find("50")
+	keys := []string{"1", "1", "1"}
+	for i := 0; i < 1000; i++ {
+		keys = append(keys, "absent"+strconv.Itoa(i))
+	}
+	trie.RemoveAllAndRebuild(keys)
+	if after, ok := trie.Find("50"); !ok || after != before {
+		t.Error("Expected a batch of mostly absent keys not to rebuild the trie")
+	}
+	if _, ok := trie.Find("1"); ok || trie.size != 99 {
+		t.Errorf("Expected only 1 to be removed, got size %d", trie.size)
+	}
+}
+
+// benchmarkRemoveMost times removing all but 5% of the dictionary,
+// enough for RemoveAllAndRebuild to rebuild.
+func benchmarkRemoveMost(b *testing.B, remove func(*Trie[interface{}], []string)) {
+	words := createTrieAndAddFromFile[interface{}]("/usr/share/dict/words", nil).Keys()
+	doomed := words[:len(words)*19/20]
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		trie := New[interface{}]()
+		for _, word := range words {
+			trie.Add(word, nil)
+		}
+		b.StartTimer()
+		remove(trie, doomed)
+	}
+}
+
+func BenchmarkRemoveLoop(b *testing.B) {
+	benchmarkRemoveMost(b, func(trie *Trie[interface{}], keys []string) {
+		for _, key := range keys {
+			trie.Remove(key)
+		}
+	})
+}
+
+func BenchmarkRemoveAllAndRebuild(b *testing.B) {
+	benchmarkRemoveMost(b, (*Trie[interface{}]).RemoveAllAndRebuild)
+}
+
+func TestCompletionsWithSavings(t *testing.T) {
+	trie := New[int]()
+	for _, key := range []string{"tea", "team", "teapot", "ten", "téa", "to"} {
+		trie.Add(key, 0)
+	}
+
+	got := trie.CompletionsWithSavings("tea")
+	expected := []Completion{{"teapot", 3}, {"team", 1}, {"tea", 0}}
+	if !slices.Equal(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+
+	got = trie.CompletionsWithSavings("t")
+	if len(got) != 6 || got[0] != (Completion{"teapot", 5}) {
+		t.Errorf("Expected six completions led by teapot, got %v", got)
+	}
+	for _, c := range got {
+		if c.Key == "téa" && c.Saved != 2 {
+			t.Errorf("Expected téa to save 2 runes, got %d", c.Saved)
+		}
+	}
+
+	if got := trie.CompletionsWithSavings("x"); len(got) != 0 {
+		t.Errorf("Expected no completions, got %v", got)
+	}
+}
+
+func TestSearchesOnEmptyTrie(t *testing.T) {
+	emptied := New[int]()
+	for _, key := range []string{"foo", "foobar", "bar"} {
+		emptied.Add(key, 0)
+	}
+	for _, key := range []string{"foobar", "foo", "bar"} {
+		emptied.Remove(key)
+	}
+
+	for name, trie := range map[string]*Trie[int]{"new": New[int](), "emptied": emptied} {
+		for _, pre := range []string{"", "f", "foo", "x"} {
+			for method, keys := range map[string][]string{
+				"PrefixSearch": trie.PrefixSearch(pre),
+				"FuzzySearch":  trie.FuzzySearch(pre),
+				"Keys":         trie.Keys(),
+			} {
+				if keys == nil || len(keys) != 0 {
+					t.Errorf("%s trie: expected %s(%q) to return an empty slice, got %#v", name, method, pre, keys)
+				}
+			}
+			for method, keys := range map[string][]string{
+				"Search":                 trie.Search(pre),
+				"KeysBFS":                trie.KeysBFS(),
+				"OrderedPrefixSearch":    trie.OrderedPrefixSearch(pre),
+				"SortedKeysDesc":         trie.SortedKeysDesc(),
+				"NearestK":               trie.NearestK(pre, 3),
+				"PrefixSearchMaxDepth":   trie.PrefixSearchMaxDepth(pre, 2),
+				"PatternSearch":          trie.PatternSearch(pre),
+				"SuffixesOfPrefix":       trie.SuffixesOfPrefix(pre),
+				"FuzzyPrefixSearch":      trie.FuzzyPrefixSearch(pre, 1),
+				"EditSearch":             trie.EditSearch(pre, 1),
+				"HammingSearch":          trie.HammingSearch(pre, 1),
+				"FuzzySearchAtLeast":     trie.FuzzySearchAtLeast(pre, 1),
+				"PrefixSearchExcluding":  trie.PrefixSearchExcluding(pre, nil),
+				"Query":                  trie.Query(pre),
+				"Query~":                 trie.Query("~" + pre),
+				"Query*":                 trie.Query(pre + "*"),
+				"SamplePrefix":           trie.SamplePrefix(pre, 2, rand.New(rand.NewSource(1))),
+				"PrefixesOf":             trie.PrefixesOf(pre),
+				"ImmediateCompletions":   trie.ImmediateCompletions(pre),
+				"MergedSortedCompletion": trie.MergedSortedCompletions([]string{pre}),
+				"KeysInRange":            trie.KeysInRange('a', 'z'),
+			} {
+				if len(keys) != 0 {
+					t.Errorf("%s trie: expected %s(%q) to find nothing, got %v", name, method, pre, keys)
+				}
+			}
+			if keys, err := trie.FuzzySearchContext(context.Background(), pre); err != nil || len(keys) != 0 {
+				t.Errorf("%s trie: expected FuzzySearchContext(%q) to find nothing, got %v, %v", name, pre, keys, err)
+			}
+			if got := trie.FuzzySearchHighlights(pre); len(got) != 0 {
+				t.Errorf("%s trie: expected no highlights for %q, got %v", name, pre, got)
+			}
+			if got := trie.FuzzySearchWeighted(pre, func(int) float64 { return 1 }); len(got) != 0 {
+				t.Errorf("%s trie: expected no weighted matches for %q, got %v", name, pre, got)
+			}
+			if got := trie.CompletionsWithSavings(pre); len(got) != 0 {
+				t.Errorf("%s trie: expected no completions for %q, got %v", name, pre, got)
+			}
+			if got := trie.GroupByNextRune(pre); len(got) != 0 {
+				t.Errorf("%s trie: expected no groups for %q, got %v", name, pre, got)
+			}
+			if got := trie.PrefixFacets(pre, 1); len(got) != 0 {
+				t.Errorf("%s trie: expected no facets for %q, got %v", name, pre, got)
+			}
+			if got := trie.FuzzyCount(pre); got != 0 {
+				t.Errorf("%s trie: expected FuzzyCount(%q) of 0, got %d", name, pre, got)
+			}
+			if _, ok := trie.Find(pre); ok {
+				t.Errorf("%s trie: expected %q not to be found", name, pre)
+			}
+			if trie.HasKeysWithPrefix(pre) || trie.HasKeyOrPrefix(pre) {
+				t.Errorf("%s trie: expected no keys with prefix %q", name, pre)
+			}
+			if _, ok := trie.Segment(pre); ok && pre != "" {
+				t.Errorf("%s trie: expected %q not to segment", name, pre)
+			}
+			if _, ok := trie.Next(pre); ok {
+				t.Errorf("%s trie: expected no key after %q", name, pre)
+			}
+			if _, ok := trie.Prev(pre); ok {
+				t.Errorf("%s trie: expected no key before %q", name, pre)
+			}
+			trie.FuzzyWalk(pre, func(key string, _ int) bool {
+				t.Errorf("%s trie: expected FuzzyWalk(%q) to visit nothing, got %s", name, pre, key)
+				return true
+			})
+		}
+
+		if _, ok := trie.LongestKey(); ok {
+			t.Errorf("%s trie: expected no longest key", name)
+		}
+		if _, ok := trie.RandomKey(rand.New(rand.NewSource(1))); ok {
+			t.Errorf("%s trie: expected no random key", name)
+		}
+		if lcp := trie.LongestCommonPrefix(); lcp != "" {
+			t.Errorf("%s trie: expected no common prefix, got %q", name, lcp)
+		}
+		if got := trie.HottestPrefixes(1, 3); len(got) != 0 {
+			t.Errorf("%s trie: expected no hot prefixes, got %v", name, got)
+		}
+		if !trie.IsEmpty() {
+			t.Errorf("%s trie: expected IsEmpty", name)
+		}
+		if err := trie.Validate(); err != nil {
+			t.Errorf("%s trie: %v", name, err)
+		}
+	}
+
+	// A trie with keys but no match reports no results the same way.
+	trie := New[int]()
+	trie.Add("foo", 0)
+	if keys := trie.PrefixSearch("x"); keys == nil || len(keys) != 0 {
+		t.Errorf("Expected PrefixSearch to return an empty slice, got %#v", keys)
+	}
+	if keys := trie.FuzzySearch("x"); keys == nil || len(keys) != 0 {
+		t.Errorf("Expected FuzzySearch to return an empty slice, got %#v", keys)
+	}
+}
+
+func TestFuzzySearchHighlightsOrder(t *testing.T) {
+	keys := []string{"Zab", "Äab", "Aab", "cab", "bab", "ab", "Bär"}
+	for _, trie := range []*Trie[int]{New[int](), New(WithCollator[int](germanCollator{}))} {
+		for _, key := range keys {
+			trie.Add(key, 0)
+		}
+		for i := 0; i < 10; i++ {
+			expected := trie.FuzzySearch("ab")
+			matches := trie.FuzzySearchHighlights("ab")
+			got := make([]string, len(matches))
+			for i, m := range matches {
+				got[i] = m.Key
+			}
+			if !slices.Equal(got, expected) {
+				t.Fatalf("Expected highlights in FuzzySearch order %v, got %v", expected, got)
+			}
+		}
+	}
+}